@@ -1,18 +1,32 @@
 package main
 
 import (
+	"archive/zip"
+	"bytes"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
 	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
 	"io"
 	"log"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"regexp"
@@ -21,6 +35,8 @@ import (
 	"sync"
 	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/cloudinary/cloudinary-go/v2"
 	"github.com/cloudinary/cloudinary-go/v2/api/uploader"
@@ -32,6 +48,7 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/patrickmn/go-cache"
 	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
 	"golang.org/x/time/rate"
 )
 
@@ -45,10 +62,17 @@ var cld *cloudinary.Cloudinary
 var jwtSecret []byte
 
 type AppConfig struct {
-	DatabaseURL     string
-	RateRPS         float64
-	RateBurst       int
-	MaxStorageBytes int64
+	DatabaseURL          string
+	RateRPS              float64
+	RateBurst            int
+	MaxStorageBytes      int64
+	MimeMismatchPolicy   string
+	ScannerBackend       string
+	ClamdAddress         string
+	PdfRendererPath      string
+	PdfTextExtractorPath string
+	LegacyPublicIDLinks  bool
+	TrustedProxies       []*net.IPNet
 }
 
 var appConfig AppConfig
@@ -95,6 +119,41 @@ func initConfig() {
 		quota = 10 * 1024 * 1024
 	}
 	appConfig.MaxStorageBytes = quota
+	appConfig.MimeMismatchPolicy = os.Getenv("MIME_MISMATCH_POLICY")
+	if appConfig.MimeMismatchPolicy != mimePolicyReject && appConfig.MimeMismatchPolicy != mimePolicyTrustContent {
+		appConfig.MimeMismatchPolicy = mimePolicyFlag
+	}
+	appConfig.ScannerBackend = os.Getenv("SCANNER_BACKEND")
+	appConfig.ClamdAddress = os.Getenv("CLAMD_ADDRESS")
+	if appConfig.ClamdAddress == "" {
+		appConfig.ClamdAddress = "localhost:3310"
+	}
+	appConfig.PdfRendererPath = os.Getenv("PDF_RENDERER_PATH")
+	if appConfig.PdfRendererPath == "" {
+		appConfig.PdfRendererPath = "pdftoppm"
+	}
+	appConfig.PdfTextExtractorPath = os.Getenv("PDF_TEXT_EXTRACTOR_PATH")
+	if appConfig.PdfTextExtractorPath == "" {
+		appConfig.PdfTextExtractorPath = "pdftotext"
+	}
+	appConfig.LegacyPublicIDLinks = os.Getenv("LEGACY_PUBLIC_ID_LINKS") == "true"
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Fatalf("FATAL: Invalid TRUSTED_PROXIES entry %q: %v", entry, err)
+		}
+		appConfig.TrustedProxies = append(appConfig.TrustedProxies, network)
+	}
 	fmt.Println("Configuration loaded successfully.")
 }
 
@@ -157,6 +216,233 @@ func initCloudinary() {
 	fmt.Println("Cloudinary client initialized successfully!")
 }
 
+const (
+	scanStatusPending  = "pending"
+	scanStatusClean    = "clean"
+	scanStatusInfected = "infected"
+)
+
+var errInfectedFile = errors.New("file failed malware scan")
+
+type ScanResult struct {
+	Clean     bool
+	Signature string
+}
+
+type Scanner interface {
+	Scan(ctx context.Context, r io.Reader) (ScanResult, error)
+}
+
+var scanner Scanner = noopScanner{}
+
+type noopScanner struct{}
+
+func (noopScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	return ScanResult{Clean: true}, nil
+}
+
+type clamdScanner struct {
+	Address string
+	Timeout time.Duration
+}
+
+func (s clamdScanner) Scan(ctx context.Context, r io.Reader) (ScanResult, error) {
+	dialer := net.Dialer{Timeout: s.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.Address)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("could not connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(s.Timeout)); err != nil {
+		return ScanResult{}, fmt.Errorf("could not set clamd deadline: %w", err)
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return ScanResult{}, fmt.Errorf("could not start clamd stream: %w", err)
+	}
+	chunk := make([]byte, 32*1024)
+	size := make([]byte, 4)
+	for {
+		n, readErr := r.Read(chunk)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, err := conn.Write(size); err != nil {
+				return ScanResult{}, fmt.Errorf("could not stream to clamd: %w", err)
+			}
+			if _, err := conn.Write(chunk[:n]); err != nil {
+				return ScanResult{}, fmt.Errorf("could not stream to clamd: %w", err)
+			}
+		}
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			return ScanResult{}, fmt.Errorf("could not read file for scanning: %w", readErr)
+		}
+	}
+	if _, err := conn.Write([]byte{0, 0, 0, 0}); err != nil {
+		return ScanResult{}, fmt.Errorf("could not finish clamd stream: %w", err)
+	}
+	reply, err := io.ReadAll(conn)
+	if err != nil {
+		return ScanResult{}, fmt.Errorf("could not read clamd reply: %w", err)
+	}
+	response := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	switch {
+	case strings.HasSuffix(response, " OK"):
+		return ScanResult{Clean: true}, nil
+	case strings.HasSuffix(response, " FOUND"):
+		signature := strings.TrimSuffix(strings.TrimPrefix(response, "stream: "), " FOUND")
+		return ScanResult{Clean: false, Signature: signature}, nil
+	}
+	return ScanResult{}, fmt.Errorf("unexpected clamd reply: %q", response)
+}
+
+func initScanner() {
+	switch appConfig.ScannerBackend {
+	case "clamd":
+		scanner = clamdScanner{Address: appConfig.ClamdAddress, Timeout: 30 * time.Second}
+		fmt.Printf("Malware scanning enabled via clamd at %s\n", appConfig.ClamdAddress)
+	case "", "none":
+		scanner = noopScanner{}
+		fmt.Println("Malware scanning disabled (no-op scanner).")
+	default:
+		log.Fatalf("FATAL: Unknown SCANNER_BACKEND %q", appConfig.ScannerBackend)
+	}
+}
+
+func scanBlocksDownload(scanStatus string) (int, string, bool) {
+	switch scanStatus {
+	case scanStatusClean:
+		return 0, "", false
+	case scanStatusInfected:
+		return http.StatusForbidden, "This file failed the malware scan and cannot be downloaded", true
+	}
+	return http.StatusLocked, "This file is still being scanned for malware", true
+}
+
+func rescanPendingFiles(ctx context.Context) {
+	type PendingFile struct {
+		ID         int
+		StorageURL string
+	}
+	rows, err := pool.Query(ctx, `SELECT id, storage_url FROM physical_files WHERE scan_status = 'pending' ORDER BY id LIMIT 50`)
+	if err != nil {
+		log.Printf("Failed to query pending scans: %v", err)
+		return
+	}
+	var pending []PendingFile
+	for rows.Next() {
+		var p PendingFile
+		if err := rows.Scan(&p.ID, &p.StorageURL); err != nil {
+			log.Printf("Failed to scan pending file row: %v", err)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	for _, p := range pending {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.StorageURL, nil)
+		if err != nil {
+			log.Printf("Rescan of physical file %d failed: %v", p.ID, err)
+			continue
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			log.Printf("Rescan of physical file %d failed: %v", p.ID, err)
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("Rescan of physical file %d failed: storage returned status %d", p.ID, resp.StatusCode)
+			continue
+		}
+		verdict, err := scanner.Scan(ctx, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			log.Printf("Rescan of physical file %d failed: %v", p.ID, err)
+			continue
+		}
+		status := scanStatusClean
+		if !verdict.Clean {
+			status = scanStatusInfected
+			log.Printf("Physical file %d flagged as infected: %s", p.ID, verdict.Signature)
+		}
+		if _, err := pool.Exec(ctx, "UPDATE physical_files SET scan_status = $1 WHERE id = $2", status, p.ID); err != nil {
+			log.Printf("Failed to record scan status for physical file %d: %v", p.ID, err)
+		}
+	}
+}
+
+func startScanWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			rescanPendingFiles(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func sweepExpiredShares(ctx context.Context) {
+	rows, err := pool.Query(ctx, `DELETE FROM file_shares fs USING user_files uf, users u WHERE fs.user_file_id = uf.id AND u.id = fs.recipient_id AND fs.expires_at <= NOW() RETURNING uf.owner_id, uf.id, uf.filename, fs.recipient_id, u.username, fs.expires_at`)
+	if err != nil {
+		log.Printf("Share expiry sweep failed: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ownerID, fileID, recipientID int
+		var filename, recipientUsername string
+		var expiresAt time.Time
+		if err := rows.Scan(&ownerID, &fileID, &filename, &recipientID, &recipientUsername, &expiresAt); err != nil {
+			log.Printf("Share expiry sweep: failed to scan row: %v", err)
+			return
+		}
+		logAuditEvent(ctx, ownerID, fileID, "FILE_SHARE_EXPIRED", map[string]interface{}{"filename": filename, "recipientId": recipientID, "recipientUsername": recipientUsername, "expiresAt": expiresAt})
+	}
+}
+
+func notifyExpiredPublicLinks(ctx context.Context) {
+	rows, err := pool.Query(ctx, `UPDATE public_links pl SET expiry_notified = TRUE FROM user_files uf WHERE pl.user_file_id = uf.id AND pl.expires_at <= NOW() AND NOT pl.expiry_notified AND pl.revoked_at IS NULL RETURNING uf.owner_id, uf.id, uf.filename, pl.id, pl.label, pl.download_count, pl.expires_at`)
+	if err != nil {
+		log.Printf("Public link expiry sweep failed: %v", err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var ownerID, fileID, linkID, downloads int
+		var filename string
+		var label *string
+		var expiresAt time.Time
+		if err := rows.Scan(&ownerID, &fileID, &filename, &linkID, &label, &downloads, &expiresAt); err != nil {
+			log.Printf("Public link expiry sweep: failed to scan row: %v", err)
+			return
+		}
+		logAuditEvent(ctx, ownerID, fileID, "PUBLIC_LINK_EXPIRED", map[string]interface{}{"filename": filename, "linkId": linkID, "label": label, "downloadCount": downloads, "expiresAt": expiresAt})
+	}
+}
+
+func startExpiryWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			sweepExpiredShares(ctx)
+			notifyExpiredPublicLinks(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
 func ensureFilesSchema(ctx context.Context) error {
 	stmts := []string{
 		`CREATE TABLE IF NOT EXISTS users (id SERIAL PRIMARY KEY, username VARCHAR(50) UNIQUE NOT NULL, password_hash TEXT NOT NULL, name VARCHAR(100) NOT NULL, role VARCHAR(20) DEFAULT 'user' NOT NULL, last_login TIMESTAMPTZ, created_at TIMESTAMPTZ DEFAULT NOW())`,
@@ -167,6 +453,47 @@ func ensureFilesSchema(ctx context.Context) error {
 		`CREATE TABLE IF NOT EXISTS audit_logs (id BIGSERIAL PRIMARY KEY, user_id INT REFERENCES users(id) ON DELETE SET NULL, action VARCHAR(50) NOT NULL, details JSONB, created_at TIMESTAMPTZ DEFAULT NOW())`,
 		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS target_id INT`,
 		`ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS details JSONB`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS detected_mime_type VARCHAR(100)`,
+		`ALTER TABLE user_files ADD COLUMN IF NOT EXISTS mime_mismatch BOOLEAN DEFAULT FALSE NOT NULL`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS scan_status VARCHAR(16) DEFAULT 'clean' NOT NULL`,
+		`ALTER TABLE physical_files ALTER COLUMN scan_status SET DEFAULT 'pending'`,
+		`CREATE INDEX IF NOT EXISTS physical_files_scan_status_idx ON physical_files(scan_status) WHERE scan_status = 'pending'`,
+		`CREATE TABLE IF NOT EXISTS mime_policy_rules (id SERIAL PRIMARY KEY, mime_pattern VARCHAR(100) NOT NULL, roles TEXT[] DEFAULT '{}' NOT NULL, action VARCHAR(10) NOT NULL CHECK (action IN ('allow', 'deny')), max_size BIGINT, created_at TIMESTAMPTZ DEFAULT NOW())`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS rendition_status VARCHAR(16) DEFAULT 'pending' NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS file_renditions (id SERIAL PRIMARY KEY, physical_hash CHAR(64) NOT NULL REFERENCES physical_files(hash) ON DELETE CASCADE, size VARCHAR(10) NOT NULL, storage_url TEXT NOT NULL, public_id TEXT NOT NULL, width INT NOT NULL, height INT NOT NULL, created_at TIMESTAMPTZ DEFAULT NOW(), UNIQUE(physical_hash, size))`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS content_text TEXT`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS content_tsv TSVECTOR`,
+		`CREATE INDEX IF NOT EXISTS physical_files_content_tsv_idx ON physical_files USING GIN (content_tsv)`,
+		`ALTER TABLE physical_files ADD COLUMN IF NOT EXISTS text_status VARCHAR(16) DEFAULT 'pending' NOT NULL`,
+		`CREATE INDEX IF NOT EXISTS physical_files_text_status_idx ON physical_files(text_status) WHERE text_status = 'pending'`,
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS user_files_filename_trgm_idx ON user_files USING GIN (filename gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS users_name_trgm_idx ON users USING GIN (name gin_trgm_ops)`,
+		`ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS permission VARCHAR(16) DEFAULT 'downloader' NOT NULL CHECK (permission IN ('viewer', 'downloader', 'editor', 'co-owner'))`,
+		`ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		`ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS status VARCHAR(10) DEFAULT 'accepted' NOT NULL CHECK (status IN ('pending', 'accepted'))`,
+		`ALTER TABLE file_shares ADD COLUMN IF NOT EXISTS shared_by INT REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE INDEX IF NOT EXISTS file_shares_pending_idx ON file_shares(recipient_id) WHERE status = 'pending'`,
+		`ALTER TABLE users ADD COLUMN IF NOT EXISTS share_invitation_mode VARCHAR(16) DEFAULT 'accept_all' NOT NULL CHECK (share_invitation_mode IN ('accept_all', 'trusted_only', 'always_ask'))`,
+		`CREATE TABLE IF NOT EXISTS trusted_share_senders (user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, sender_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, trusted_at TIMESTAMPTZ DEFAULT NOW(), PRIMARY KEY (user_id, sender_id))`,
+		`CREATE TABLE IF NOT EXISTS declined_share_senders (user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, sender_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, declined_at TIMESTAMPTZ DEFAULT NOW(), PRIMARY KEY (user_id, sender_id))`,
+		`CREATE INDEX IF NOT EXISTS file_shares_expires_at_idx ON file_shares(expires_at) WHERE expires_at IS NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS public_links (id SERIAL PRIMARY KEY, user_file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE, token VARCHAR(64) UNIQUE NOT NULL, label VARCHAR(100), created_by INT REFERENCES users(id) ON DELETE SET NULL, download_count INT DEFAULT 0 NOT NULL, created_at TIMESTAMPTZ DEFAULT NOW(), revoked_at TIMESTAMPTZ)`,
+		`CREATE INDEX IF NOT EXISTS public_links_user_file_id_idx ON public_links(user_file_id) WHERE revoked_at IS NULL`,
+		`ALTER TABLE public_links ADD COLUMN IF NOT EXISTS password_hash TEXT`,
+		`ALTER TABLE public_links ADD COLUMN IF NOT EXISTS max_downloads INT CHECK (max_downloads > 0)`,
+		`ALTER TABLE public_links ADD COLUMN IF NOT EXISTS expires_at TIMESTAMPTZ`,
+		`ALTER TABLE public_links ADD COLUMN IF NOT EXISTS expiry_notified BOOLEAN DEFAULT FALSE NOT NULL`,
+		`CREATE TABLE IF NOT EXISTS user_groups (id SERIAL PRIMARY KEY, name VARCHAR(100) NOT NULL, owner_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, created_at TIMESTAMPTZ DEFAULT NOW(), UNIQUE(owner_id, name))`,
+		`CREATE TABLE IF NOT EXISTS group_members (group_id INT NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE, user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, role VARCHAR(10) DEFAULT 'member' NOT NULL CHECK (role IN ('member', 'admin')), added_at TIMESTAMPTZ DEFAULT NOW(), PRIMARY KEY (group_id, user_id))`,
+		`CREATE INDEX IF NOT EXISTS group_members_user_id_idx ON group_members(user_id)`,
+		`ALTER TABLE group_members ADD COLUMN IF NOT EXISTS status VARCHAR(10) DEFAULT 'accepted' NOT NULL CHECK (status IN ('pending', 'accepted'))`,
+		`ALTER TABLE group_members ADD COLUMN IF NOT EXISTS added_by INT REFERENCES users(id) ON DELETE SET NULL`,
+		`CREATE TABLE IF NOT EXISTS group_file_shares (id SERIAL PRIMARY KEY, user_file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE, group_id INT NOT NULL REFERENCES user_groups(id) ON DELETE CASCADE, permission VARCHAR(16) DEFAULT 'downloader' NOT NULL CHECK (permission IN ('viewer', 'downloader', 'editor', 'co-owner')), shared_by INT REFERENCES users(id) ON DELETE SET NULL, shared_at TIMESTAMPTZ DEFAULT NOW(), UNIQUE(user_file_id, group_id))`,
+		`CREATE INDEX IF NOT EXISTS group_file_shares_group_id_idx ON group_file_shares(group_id)`,
+		`CREATE TABLE IF NOT EXISTS access_requests (id SERIAL PRIMARY KEY, user_file_id INT NOT NULL REFERENCES user_files(id) ON DELETE CASCADE, requester_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, message TEXT NOT NULL DEFAULT '', status VARCHAR(10) DEFAULT 'pending' NOT NULL CHECK (status IN ('pending', 'approved', 'denied')), permission VARCHAR(16) CHECK (permission IN ('viewer', 'downloader', 'editor', 'co-owner')), created_at TIMESTAMPTZ DEFAULT NOW(), resolved_at TIMESTAMPTZ, resolved_by INT REFERENCES users(id) ON DELETE SET NULL)`,
+		`CREATE UNIQUE INDEX IF NOT EXISTS access_requests_pending_idx ON access_requests(user_file_id, requester_id) WHERE status = 'pending'`,
+		`CREATE TABLE IF NOT EXISTS saved_searches (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, name VARCHAR(100) NOT NULL, definition JSONB NOT NULL, pinned BOOLEAN DEFAULT FALSE NOT NULL, position INT, created_at TIMESTAMPTZ DEFAULT NOW(), updated_at TIMESTAMPTZ DEFAULT NOW(), UNIQUE(user_id, name))`,
 		`CREATE INDEX IF NOT EXISTS user_files_owner_id_idx ON user_files(owner_id)`,
 		`CREATE INDEX IF NOT EXISTS physical_files_hash_idx ON physical_files(hash)`,
 		`CREATE INDEX IF NOT EXISTS file_shares_recipient_id_idx ON file_shares(recipient_id)`,
@@ -192,11 +519,14 @@ func logAuditEvent(ctx context.Context, userID, targetID int, action string, det
 			}
 			detailsArg = string(detailsJSON)
 		}
-		var userIDArg interface{}
+		var userIDArg, targetIDArg interface{}
 		if userID != 0 {
 			userIDArg = userID
 		}
-		_, err := pool.Exec(ctx, `INSERT INTO audit_logs (user_id, action, target_id, details) VALUES ($1, $2, $3, $4)`, userIDArg, action, targetID, detailsArg)
+		if targetID != 0 {
+			targetIDArg = targetID
+		}
+		_, err := pool.Exec(ctx, `INSERT INTO audit_logs (user_id, action, target_id, details) VALUES ($1, $2, $3, $4)`, userIDArg, action, targetIDArg, detailsArg)
 		if err != nil {
 			log.Printf("ERROR: Failed to write audit log event: %v", err)
 		}
@@ -244,9 +574,6 @@ func verifyCredentialsAndGetUser(ctx context.Context, username, password string)
 func authMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		tokenString := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
-		if tokenString == "" {
-			tokenString = r.URL.Query().Get("token")
-		}
 		if tokenString == "" {
 			writeError(w, http.StatusUnauthorized, "Authorization token required")
 			return
@@ -385,6 +712,74 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "healthy", "time": time.Now().Format(time.RFC3339)})
 }
 
+type FileUploadResult struct {
+	Filename   string                 `json:"filename"`
+	Status     string                 `json:"status"`
+	Error      string                 `json:"error,omitempty"`
+	StatusCode int                    `json:"statusCode,omitempty"`
+	File       map[string]interface{} `json:"file,omitempty"`
+}
+
+type uploadedBlob struct {
+	PublicID     string
+	ResourceType string
+}
+
+func destroyUploadedBlobs(blobs []uploadedBlob) {
+	for _, b := range blobs {
+		if _, err := cld.Upload.Destroy(context.Background(), uploader.DestroyParams{PublicID: b.PublicID, ResourceType: b.ResourceType}); err != nil {
+			log.Printf("Orphaned file warning: Could not delete file %s from Cloudinary: %v", b.PublicID, err)
+		}
+	}
+}
+
+func hashMultipartFile(header *multipart.FileHeader) (string, error) {
+	file, err := header.Open()
+	if err != nil {
+		return "", fmt.Errorf("could not open file for processing: %w", err)
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("could not hash file: %w", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func uploadErrorResponse(filename string, err error) (int, string) {
+	switch {
+	case errors.Is(err, errInfectedFile):
+		return http.StatusUnprocessableEntity, fmt.Sprintf("File %s rejected: %v", filename, err)
+	case errors.Is(err, errMimePolicyViolation), errors.Is(err, errMimeMismatch):
+		return http.StatusUnsupportedMediaType, fmt.Sprintf("File %s rejected: %v", filename, err)
+	case errors.Is(err, errFilenameConflict):
+		return http.StatusConflict, fmt.Sprintf("A file named %s already exists", filename)
+	}
+	return http.StatusInternalServerError, fmt.Sprintf("Failed to process file %s: %v", filename, err)
+}
+
+func quotaExceededMessage(usageBytes int64) string {
+	return fmt.Sprintf("Storage quota exceeded. Your current usage is %.2f MB. This upload would exceed the %.2f MB limit.", float64(usageBytes)/1024/1024, float64(appConfig.MaxStorageBytes)/1024/1024)
+}
+
+func logFileUpload(ctx context.Context, userID int, processedFile map[string]interface{}) {
+	details := map[string]interface{}{"filename": processedFile["filename"], "size": processedFile["size"], "deduplicated": processedFile["wasDeduplicated"], "conflictPolicy": processedFile["conflictPolicy"]}
+	if replacedID, ok := processedFile["replacedFileId"]; ok {
+		details["replacedFileId"] = replacedID
+	}
+	if rawName, ok := processedFile["originalFilename"]; ok {
+		details["rawFilename"] = rawName
+	}
+	logAuditEvent(ctx, userID, processedFile["userFileId"].(int), "FILE_UPLOAD", details)
+	if mismatch, ok := processedFile["mimeMismatch"].(map[string]interface{}); ok {
+		mismatchDetails := map[string]interface{}{"filename": processedFile["filename"]}
+		for k, v := range mismatch {
+			mismatchDetails[k] = v
+		}
+		logAuditEvent(ctx, userID, processedFile["userFileId"].(int), "FILE_MIME_MISMATCH", mismatchDetails)
+	}
+}
+
 func uploadHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userContextKey).(*AuthenticatedUser)
@@ -397,249 +792,4032 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "No files provided in 'files' field")
 		return
 	}
-	var uploadedFiles []map[string]interface{}
-	var newFilesSize int64 = 0
-	var newHashes = make(map[string]bool)
 	var currentUsageBytes int64
 	err := pool.QueryRow(ctx, `SELECT COALESCE(SUM(pf.size), 0) FROM physical_files pf WHERE pf.id IN (SELECT DISTINCT physical_file_id FROM user_files WHERE owner_id = $1)`, user.ID).Scan(&currentUsageBytes)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Could not retrieve user storage usage")
 		return
 	}
+	conflictPolicy := r.FormValue("onConflict")
+	if conflictPolicy == "" {
+		conflictPolicy = conflictKeepBoth
+	}
+	if conflictPolicy != conflictKeepBoth && conflictPolicy != conflictReplace && conflictPolicy != conflictReject {
+		writeError(w, http.StatusBadRequest, "Invalid onConflict policy. Use keep-both, replace, or reject")
+		return
+	}
+	if r.FormValue("atomic") == "true" {
+		atomicUpload(w, r, user, files, currentUsageBytes, conflictPolicy)
+		return
+	}
+	var results []FileUploadResult
+	var uploadedFiles []map[string]interface{}
+	var newFilesSize int64 = 0
+	var newHashes = make(map[string]bool)
 	for _, fileHeader := range files {
-		file, err := fileHeader.Open()
+		result := FileUploadResult{Filename: fileHeader.Filename, Status: "failed"}
+		hashStr, err := hashMultipartFile(fileHeader)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Could not open file for processing")
-			return
-		}
-		hash := sha256.New()
-		if _, err := io.Copy(hash, file); err != nil {
-			file.Close()
-			writeError(w, http.StatusInternalServerError, "Could not hash file")
-			return
+			result.Error = err.Error()
+			results = append(results, result)
+			continue
 		}
-		file.Close()
-		hashStr := hex.EncodeToString(hash.Sum(nil))
 		var existsInDB bool
 		err = pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM physical_files WHERE hash = $1)", hashStr).Scan(&existsInDB)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Database error during duplicate check")
-			return
+			result.Error = "Database error during duplicate check"
+			results = append(results, result)
+			continue
 		}
-		_, existsInBatch := newHashes[hashStr]
-		if !existsInDB && !existsInBatch {
-			if currentUsageBytes+newFilesSize+fileHeader.Size > appConfig.MaxStorageBytes {
-				errorMessage := fmt.Sprintf("Storage quota exceeded. Your current usage is %.2f MB. This upload would exceed the %.2f MB limit.", float64(currentUsageBytes+newFilesSize)/1024/1024, float64(appConfig.MaxStorageBytes)/1024/1024)
-				writeError(w, http.StatusForbidden, errorMessage)
-				return
-			}
-			newFilesSize += fileHeader.Size
-			newHashes[hashStr] = true
+		isNewContent := !existsInDB && !newHashes[hashStr]
+		if isNewContent && currentUsageBytes+newFilesSize+fileHeader.Size > appConfig.MaxStorageBytes {
+			result.Error = quotaExceededMessage(currentUsageBytes + newFilesSize)
+			results = append(results, result)
+			continue
+		}
+		insp, err := inspectUpload(ctx, user, fileHeader, hashStr)
+		if err != nil {
+			result.StatusCode, result.Error = uploadErrorResponse(fileHeader.Filename, err)
+			results = append(results, result)
+			continue
 		}
 		tx, err := pool.Begin(ctx)
 		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Could not start transaction")
-			return
+			result.Error = "Could not start transaction"
+			results = append(results, result)
+			continue
+		}
+		processedFile, blob, released, err := processAndUploadFile(ctx, tx, user, fileHeader, hashStr, conflictPolicy, insp)
+		if err == nil {
+			err = tx.Commit(ctx)
 		}
-		processedFile, err := processAndUploadFile(ctx, tx, user.ID, fileHeader, hashStr)
 		if err != nil {
 			tx.Rollback(ctx)
-			writeError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to process file %s: %v", fileHeader.Filename, err))
-			return
+			if blob != nil {
+				destroyUploadedBlobs([]uploadedBlob{*blob})
+			}
+			result.StatusCode, result.Error = uploadErrorResponse(fileHeader.Filename, err)
+			results = append(results, result)
+			continue
 		}
-		if err := tx.Commit(ctx); err != nil {
-			writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
-			return
+		destroyUploadedBlobs(released)
+		if isNewContent {
+			newFilesSize += fileHeader.Size
+			newHashes[hashStr] = true
 		}
+		logFileUpload(ctx, user.ID, processedFile)
+		result.Status = "uploaded"
+		result.File = processedFile
+		results = append(results, result)
 		uploadedFiles = append(uploadedFiles, processedFile)
 	}
-	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": "Files uploaded successfully", "uploadedCount": len(uploadedFiles), "files": uploadedFiles})
+	status := http.StatusCreated
+	message := "Files uploaded successfully"
+	if len(uploadedFiles) < len(files) {
+		status = http.StatusMultiStatus
+		message = fmt.Sprintf("%d of %d files uploaded", len(uploadedFiles), len(files))
+	}
+	if len(uploadedFiles) == 0 && allRejectedAs(results, http.StatusUnsupportedMediaType) {
+		status = http.StatusUnsupportedMediaType
+		message = "All files were rejected by the upload content policy"
+	}
+	writeJSON(w, status, map[string]interface{}{"message": message, "uploadedCount": len(uploadedFiles), "failedCount": len(files) - len(uploadedFiles), "files": uploadedFiles, "results": results})
 }
 
-func processAndUploadFile(ctx context.Context, tx pgx.Tx, userID int, header *multipart.FileHeader, hashStr string) (map[string]interface{}, error) {
-	file, err := header.Open()
-	if err != nil {
-		return nil, fmt.Errorf("could not open file header: %w", err)
+func allRejectedAs(results []FileUploadResult, statusCode int) bool {
+	for _, result := range results {
+		if result.StatusCode != statusCode {
+			return false
+		}
 	}
-	defer file.Close()
-	var finalMimeType string
-	ext := filepath.Ext(header.Filename)
-	finalMimeType = mime.TypeByExtension(ext)
-	if finalMimeType == "" {
-		buffer := make([]byte, 512)
-		_, err = file.Read(buffer)
-		if err != nil && err != io.EOF {
-			return nil, fmt.Errorf("could not read file header for MIME detection: %w", err)
+	return len(results) > 0
+}
+
+func atomicUpload(w http.ResponseWriter, r *http.Request, user *AuthenticatedUser, files []*multipart.FileHeader, currentUsageBytes int64, conflictPolicy string) {
+	ctx := r.Context()
+	hashes := make([]string, len(files))
+	inspections := make([]*inspectedUpload, len(files))
+	for i, fileHeader := range files {
+		hashStr, err := hashMultipartFile(fileHeader)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]interface{}{"error": err.Error(), "failedFile": fileHeader.Filename, "uploadedCount": 0})
+			return
+		}
+		insp, err := inspectUpload(ctx, user, fileHeader, hashStr)
+		if err != nil {
+			status, message := uploadErrorResponse(fileHeader.Filename, err)
+			writeJSON(w, status, map[string]interface{}{"error": message, "failedFile": fileHeader.Filename, "uploadedCount": 0})
+			return
 		}
-		finalMimeType = http.DetectContentType(buffer)
+		hashes[i], inspections[i] = hashStr, insp
 	}
-	if _, err := file.Seek(0, 0); err != nil {
-		return nil, fmt.Errorf("could not seek file after MIME check: %w", err)
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
 	}
-	var physicalFileID int
-	var wasDeduplicated bool
-	err = tx.QueryRow(ctx, "SELECT id FROM physical_files WHERE hash = $1", hashStr).Scan(&physicalFileID)
-	if err == pgx.ErrNoRows {
-		wasDeduplicated = false
-		resourceType := getResourceTypeFromMIME(finalMimeType)
-		uploadParams := uploader.UploadParams{ResourceType: resourceType, Type: "upload", Moderation: "manual"}
-		uploadResult, uploadErr := cld.Upload.Upload(ctx, file, uploadParams)
-		if uploadErr != nil {
-			return nil, fmt.Errorf("cloudinary upload failed: %w", uploadErr)
+	defer tx.Rollback(ctx)
+	var blobs, released []uploadedBlob
+	fail := func(status int, filename, message string) {
+		tx.Rollback(ctx)
+		destroyUploadedBlobs(blobs)
+		writeJSON(w, status, map[string]interface{}{"error": message, "failedFile": filename, "uploadedCount": 0})
+	}
+	var uploadedFiles []map[string]interface{}
+	var newFilesSize int64 = 0
+	for i, fileHeader := range files {
+		hashStr := hashes[i]
+		var existsInDB bool
+		err = tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM physical_files WHERE hash = $1)", hashStr).Scan(&existsInDB)
+		if err != nil {
+			fail(http.StatusInternalServerError, fileHeader.Filename, "Database error during duplicate check")
+			return
 		}
-		insertErr := tx.QueryRow(ctx, `INSERT INTO physical_files (hash, storage_url, public_id, size, mime_type) VALUES ($1, $2, $3, $4, $5) RETURNING id`, hashStr, uploadResult.SecureURL, uploadResult.PublicID, header.Size, finalMimeType).Scan(&physicalFileID)
-		if insertErr != nil {
-			return nil, fmt.Errorf("failed to insert new physical file record: %w", insertErr)
+		if !existsInDB {
+			if currentUsageBytes+newFilesSize+fileHeader.Size > appConfig.MaxStorageBytes {
+				fail(http.StatusForbidden, fileHeader.Filename, quotaExceededMessage(currentUsageBytes+newFilesSize))
+				return
+			}
+			newFilesSize += fileHeader.Size
 		}
-	} else if err != nil {
-		return nil, fmt.Errorf("failed to check for existing file hash: %w", err)
-	} else {
-		wasDeduplicated = true
-		_, updateErr := tx.Exec(ctx, "UPDATE physical_files SET ref_count = ref_count + 1 WHERE id = $1", physicalFileID)
-		if updateErr != nil {
-			return nil, fmt.Errorf("failed to update reference count for duplicate file: %w", updateErr)
+		processedFile, blob, replaced, err := processAndUploadFile(ctx, tx, user, fileHeader, hashStr, conflictPolicy, inspections[i])
+		if blob != nil {
+			blobs = append(blobs, *blob)
 		}
+		released = append(released, replaced...)
+		if err != nil {
+			status, message := uploadErrorResponse(fileHeader.Filename, err)
+			fail(status, fileHeader.Filename, message)
+			return
+		}
+		uploadedFiles = append(uploadedFiles, processedFile)
 	}
-	var userFileID int
-	var uploadedAt time.Time
-	err = tx.QueryRow(ctx, `INSERT INTO user_files (owner_id, physical_file_id, filename) VALUES ($1, $2, $3) RETURNING id, uploaded_at`, userID, physicalFileID, header.Filename).Scan(&userFileID, &uploadedAt)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create user file reference: %w", err)
+	if err := tx.Commit(ctx); err != nil {
+		fail(http.StatusInternalServerError, "", "Failed to commit transaction")
+		return
+	}
+	destroyUploadedBlobs(released)
+	for _, processedFile := range uploadedFiles {
+		logFileUpload(ctx, user.ID, processedFile)
 	}
-	logAuditEvent(ctx, userID, userFileID, "FILE_UPLOAD", map[string]interface{}{"filename": header.Filename, "size": header.Size, "deduplicated": wasDeduplicated})
-	return map[string]interface{}{"userFileId": userFileID, "filename": header.Filename, "size": header.Size, "uploadedAt": uploadedAt, "wasDeduplicated": wasDeduplicated}, nil
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": "Files uploaded successfully", "atomic": true, "uploadedCount": len(uploadedFiles), "files": uploadedFiles})
 }
 
-func searchFilesHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	var req struct {
-		Filters struct {
-			Filename  *string    `json:"filename"`
-			OwnerName *string    `json:"ownerName"`
-			MimeType  *string    `json:"mimeType"`
-			MinSize   *int64     `json:"minSize"`
-			MaxSize   *int64     `json:"maxSize"`
-			StartDate *time.Time `json:"startDate"`
-			EndDate   *time.Time `json:"endDate"`
-		} `json:"filters"`
+const (
+	mimePolicyReject       = "reject"
+	mimePolicyTrustContent = "trust-content"
+	mimePolicyFlag         = "flag"
+)
+
+var errMimeMismatch = errors.New("content type mismatch")
+
+type contentSignature struct {
+	Offset   int
+	Magic    []byte
+	MimeType string
+}
+
+var extraContentSignatures = []contentSignature{
+	{0, []byte("\x7fELF"), "application/x-executable"},
+	{0, []byte{0xD0, 0xCF, 0x11, 0xE0, 0xA1, 0xB1, 0x1A, 0xE1}, "application/x-ole-storage"},
+	{0, []byte{'7', 'z', 0xBC, 0xAF, 0x27, 0x1C}, "application/x-7z-compressed"},
+	{257, []byte("ustar"), "application/x-tar"},
+}
+
+var compatibleContentTypes = map[string][]string{
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document":   {"application/zip"},
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":         {"application/zip"},
+	"application/vnd.openxmlformats-officedocument.presentationml.presentation": {"application/zip"},
+	"application/msword":            {"application/x-ole-storage"},
+	"application/vnd.ms-excel":      {"application/x-ole-storage"},
+	"application/vnd.ms-powerpoint": {"application/x-ole-storage"},
+	"application/rtf":               {"text/plain"},
+	"application/json":              {"text/plain"},
+	"application/xml":               {"text/xml", "text/plain"},
+	"image/svg+xml":                 {"text/xml", "text/plain"},
+	"audio/wav":                     {"audio/wave"},
+	"audio/ogg":                     {"application/ogg"},
+	"video/quicktime":               {"video/mp4"},
+	"video/x-matroska":              {"video/webm"},
+	"audio/mpeg":                    {"application/octet-stream"},
+	"audio/aac":                     {"application/octet-stream"},
+	"video/mp2t":                    {"application/octet-stream"},
+	"application/x-msdownload":      {"application/octet-stream"},
+}
+
+func baseMIME(mimeType string) string {
+	if mediaType, _, err := mime.ParseMediaType(mimeType); err == nil {
+		return mediaType
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid JSON body for searching/filtering")
-		return
+	return strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+}
+
+type mimeCategory struct {
+	MimePatterns []string
+	Extensions   []string
+}
+
+var mimeCategories = map[string]mimeCategory{
+	"image": {MimePatterns: []string{"image/*"}},
+	"video": {MimePatterns: []string{"video/*"}},
+	"audio": {MimePatterns: []string{"audio/*"}},
+	"document": {
+		MimePatterns: []string{"application/pdf", "application/msword", "application/vnd.openxmlformats-officedocument.*", "application/vnd.ms-excel", "application/vnd.ms-powerpoint", "application/vnd.oasis.opendocument.*", "application/rtf", "text/rtf", "text/plain", "text/csv", "text/markdown"},
+		Extensions:   []string{"pdf", "doc", "docx", "xls", "xlsx", "ppt", "pptx", "odt", "ods", "odp", "rtf", "txt", "csv", "md"},
+	},
+	"archive": {
+		MimePatterns: []string{"application/zip", "application/vnd.rar", "application/x-rar-compressed", "application/x-7z-compressed", "application/x-tar", "application/gzip", "application/x-gzip", "application/x-bzip2", "application/x-xz"},
+		Extensions:   []string{"zip", "rar", "7z", "tar", "gz", "tgz", "bz2", "xz"},
+	},
+	"code": {
+		MimePatterns: []string{"application/json", "application/xml", "text/xml", "application/javascript", "text/javascript", "text/html", "text/css", "text/x-*", "application/x-sh", "application/x-yaml", "application/sql"},
+		Extensions:   []string{"go", "py", "js", "jsx", "ts", "tsx", "java", "c", "h", "cpp", "hpp", "cs", "rb", "rs", "php", "swift", "kt", "sh", "sql", "json", "xml", "yaml", "yml", "html", "css", "scss"},
+	},
+}
+
+func mimeLikePatterns(values []string) []string {
+	patterns := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = baseMIME(v); v != "" {
+			patterns = append(patterns, strings.ReplaceAll(v, "*", "%"))
+		}
 	}
-	baseQuery := `SELECT uf.id, uf.filename, pf.size, pf.mime_type, uf.is_public, uf.download_count, uf.uploaded_at, pf.storage_url, u_owner.name AS owner_name, pf.ref_count, CASE WHEN uf.owner_id = $1 THEN NULL ELSE u_owner.name END AS shared_by FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id LEFT JOIN file_shares fs ON uf.id = fs.user_file_id WHERE (uf.owner_id = $1 OR fs.recipient_id = $1)`
-	args := []interface{}{user.ID}
-	conditions := []string{}
-	argID := 2
-	if req.Filters.Filename != nil && *req.Filters.Filename != "" {
-		conditions = append(conditions, fmt.Sprintf("uf.filename ILIKE $%d", argID))
-		args = append(args, "%"+*req.Filters.Filename+"%")
-		argID++
+	return patterns
+}
+
+func extensionLikePatterns(values []string) []string {
+	patterns := make([]string, 0, len(values))
+	for _, v := range values {
+		if v = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), ".")); v != "" {
+			patterns = append(patterns, "%."+v)
+		}
 	}
-	if req.Filters.OwnerName != nil && *req.Filters.OwnerName != "" {
-		conditions = append(conditions, fmt.Sprintf("u_owner.name ILIKE $%d", argID))
-		args = append(args, "%"+*req.Filters.OwnerName+"%")
-		argID++
+	return patterns
+}
+
+const baseMIMEExpr = "LOWER(TRIM(split_part(pf.mime_type, ';', 1)))"
+
+func categoryPatterns(names []string) ([]string, []string, error) {
+	var mimePatterns, extensions []string
+	for _, name := range names {
+		category, ok := mimeCategories[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown category %q", name)
+		}
+		mimePatterns = append(mimePatterns, category.MimePatterns...)
+		extensions = append(extensions, category.Extensions...)
 	}
-	if req.Filters.MimeType != nil && *req.Filters.MimeType != "" {
-		conditions = append(conditions, fmt.Sprintf("pf.mime_type = $%d", argID))
-		args = append(args, *req.Filters.MimeType)
-		argID++
+	return mimeLikePatterns(mimePatterns), extensionLikePatterns(extensions), nil
+}
+
+func isPortableExecutable(buf []byte) bool {
+	if len(buf) < 0x40 || string(buf[:2]) != "MZ" {
+		return false
+	}
+	offset := int(binary.LittleEndian.Uint32(buf[0x3C:0x40]))
+	return offset >= 0x40 && offset+4 <= len(buf) && string(buf[offset:offset+4]) == "PE\x00\x00"
+}
+
+func detectContentMIME(buf []byte) string {
+	if isPortableExecutable(buf) {
+		return "application/x-msdownload"
+	}
+	for _, sig := range extraContentSignatures {
+		if len(buf) >= sig.Offset+len(sig.Magic) && string(buf[sig.Offset:sig.Offset+len(sig.Magic)]) == string(sig.Magic) {
+			return sig.MimeType
+		}
+	}
+	return http.DetectContentType(buf)
+}
+
+func mimeTypesCompatible(extMimeType, contentMimeType string) bool {
+	extBase, contentBase := baseMIME(extMimeType), baseMIME(contentMimeType)
+	if extBase == contentBase {
+		return true
+	}
+	if strings.HasPrefix(extBase, "text/") && contentBase == "text/plain" {
+		return true
+	}
+	for _, alias := range compatibleContentTypes[extBase] {
+		if alias == contentBase {
+			return true
+		}
+	}
+	return false
+}
+
+type MimePolicyRule struct {
+	ID          int      `json:"id"`
+	MimePattern string   `json:"mimePattern"`
+	Roles       []string `json:"roles"`
+	Action      string   `json:"action"`
+	MaxSize     *int64   `json:"maxSize,omitempty"`
+}
+
+var errMimePolicyViolation = errors.New("blocked by upload policy")
+
+var (
+	mimePolicyMu    sync.RWMutex
+	mimePolicyRules []MimePolicyRule
+)
+
+func matchMimePattern(pattern, mimeType string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if pattern == "*" || pattern == "*/*" {
+		return true
+	}
+	base := baseMIME(mimeType)
+	if strings.HasSuffix(pattern, "/*") {
+		return strings.HasPrefix(base, strings.TrimSuffix(pattern, "*"))
+	}
+	return base == baseMIME(pattern)
+}
+
+func ruleAppliesToRole(rule MimePolicyRule, role string) bool {
+	if len(rule.Roles) == 0 {
+		return true
+	}
+	for _, r := range rule.Roles {
+		if r == role || r == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+func evaluateMimePolicy(role, mimeType string, size int64) string {
+	mimePolicyMu.RLock()
+	defer mimePolicyMu.RUnlock()
+	allowRulesMatched := false
+	for _, rule := range mimePolicyRules {
+		if !matchMimePattern(rule.MimePattern, mimeType) {
+			continue
+		}
+		if rule.Action == "deny" && ruleAppliesToRole(rule, role) {
+			return fmt.Sprintf("file type %s is not allowed", baseMIME(mimeType))
+		}
+		if rule.Action == "allow" {
+			allowRulesMatched = true
+		}
+	}
+	if !allowRulesMatched {
+		return ""
+	}
+	for _, rule := range mimePolicyRules {
+		if rule.Action != "allow" || !matchMimePattern(rule.MimePattern, mimeType) || !ruleAppliesToRole(rule, role) {
+			continue
+		}
+		if rule.MaxSize != nil && size > *rule.MaxSize {
+			return fmt.Sprintf("file type %s is limited to %d bytes for role %s", baseMIME(mimeType), *rule.MaxSize, role)
+		}
+		return ""
+	}
+	return fmt.Sprintf("file type %s is not allowed for role %s", baseMIME(mimeType), role)
+}
+
+func loadMimePolicy(ctx context.Context) error {
+	rows, err := pool.Query(ctx, `SELECT id, mime_pattern, roles, action, max_size FROM mime_policy_rules ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to query mime policy: %w", err)
+	}
+	defer rows.Close()
+	var rules []MimePolicyRule
+	for rows.Next() {
+		var rule MimePolicyRule
+		if err := rows.Scan(&rule.ID, &rule.MimePattern, &rule.Roles, &rule.Action, &rule.MaxSize); err != nil {
+			return fmt.Errorf("failed to scan mime policy rule: %w", err)
+		}
+		rules = append(rules, rule)
+	}
+	mimePolicyMu.Lock()
+	mimePolicyRules = rules
+	mimePolicyMu.Unlock()
+	return nil
+}
+
+const (
+	maxExtractedTextBytes = 512 * 1024
+	maxIndexSourceBytes   = 64 << 20
+	textExtractionTimeout = 30 * time.Second
+)
+
+const (
+	textStatusPending     = "pending"
+	textStatusIndexed     = "indexed"
+	textStatusUnsupported = "unsupported"
+	textStatusFailed      = "failed"
+)
+
+func isExtractableMIME(mimeType string) bool {
+	switch baseMIME(mimeType) {
+	case "text/plain", "text/csv", "application/json", "application/xml", "text/xml", "application/pdf", "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		return true
+	}
+	return false
+}
+
+func textStatusFor(mimeType string, extractErr error) string {
+	switch {
+	case extractErr != nil:
+		return textStatusFailed
+	case !isExtractableMIME(mimeType):
+		return textStatusUnsupported
+	}
+	return textStatusIndexed
+}
+
+func extractDocumentText(ctx context.Context, file interface {
+	io.Reader
+	io.ReaderAt
+}, size int64, mimeType string) (string, error) {
+	var text string
+	switch baseMIME(mimeType) {
+	case "text/plain", "text/csv", "application/json":
+		data, err := io.ReadAll(io.LimitReader(file, maxExtractedTextBytes))
+		if err != nil {
+			return "", fmt.Errorf("could not read text content: %w", err)
+		}
+		text = string(data)
+	case "application/xml", "text/xml":
+		extracted, err := extractXMLText(io.LimitReader(file, 8*maxExtractedTextBytes), "")
+		if err != nil {
+			return "", err
+		}
+		text = extracted
+	case "application/vnd.openxmlformats-officedocument.wordprocessingml.document":
+		zr, err := zip.NewReader(file, size)
+		if err != nil {
+			return "", fmt.Errorf("could not open docx archive: %w", err)
+		}
+		for _, entry := range zr.File {
+			if entry.Name != "word/document.xml" {
+				continue
+			}
+			rc, err := entry.Open()
+			if err != nil {
+				return "", fmt.Errorf("could not open docx body: %w", err)
+			}
+			extracted, err := extractXMLText(io.LimitReader(rc, 16*maxExtractedTextBytes), "p")
+			rc.Close()
+			if err != nil {
+				return "", err
+			}
+			text = extracted
+		}
+	case "application/pdf":
+		dir, input, err := stagePDF(file)
+		if err != nil {
+			return "", err
+		}
+		defer os.RemoveAll(dir)
+		ctx, cancel := context.WithTimeout(ctx, textExtractionTimeout)
+		defer cancel()
+		out, err := exec.CommandContext(ctx, appConfig.PdfTextExtractorPath, "-enc", "UTF-8", "-nopgbrk", input, "-").Output()
+		if err != nil {
+			return "", fmt.Errorf("pdf text extractor failed: %w", err)
+		}
+		text = string(out)
+	default:
+		return "", nil
+	}
+	return cleanExtractedText(text), nil
+}
+
+func extractXMLText(r io.Reader, paragraphElement string) (string, error) {
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+	var sb strings.Builder
+	for sb.Len() < maxExtractedTextBytes {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", fmt.Errorf("could not parse xml content: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.CharData:
+			sb.Write(t)
+			if paragraphElement == "" {
+				sb.WriteByte(' ')
+			}
+		case xml.EndElement:
+			if t.Name.Local == paragraphElement {
+				sb.WriteByte('\n')
+			}
+		}
+	}
+	return sb.String(), nil
+}
+
+func cleanExtractedText(text string) string {
+	text = strings.ToValidUTF8(text, "")
+	text = strings.ReplaceAll(text, "\x00", "")
+	if len(text) > maxExtractedTextBytes {
+		text = strings.ToValidUTF8(text[:maxExtractedTextBytes], "")
+	}
+	return strings.TrimSpace(text)
+}
+
+const maxFilenameLength = 255
+
+func isBidiControl(r rune) bool {
+	switch {
+	case r == '\u061C', r == '\u200E', r == '\u200F':
+		return true
+	case r >= '\u202A' && r <= '\u202E':
+		return true
+	case r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
+
+func sanitizeFilename(raw string) string {
+	name := strings.ReplaceAll(raw, "\\", "/")
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ToValidUTF8(name, "")
+	name = norm.NFC.String(name)
+	name = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || isBidiControl(r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		name = "unnamed"
+	}
+	runes := []rune(name)
+	if len(runes) > maxFilenameLength {
+		ext := []rune(filepath.Ext(name))
+		if len(ext) >= maxFilenameLength/2 {
+			ext = nil
+		}
+		runes = append(runes[:maxFilenameLength-len(ext)], ext...)
+	}
+	return string(runes)
+}
+
+const (
+	conflictKeepBoth = "keep-both"
+	conflictReplace  = "replace"
+	conflictReject   = "reject"
+)
+
+var errFilenameConflict = errors.New("filename already exists")
+
+func resolveFilenameConflict(ctx context.Context, tx pgx.Tx, userID int, filename, policy string) (string, int, string, error) {
+	if _, err := tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", int64(userID)); err != nil {
+		return "", 0, "", fmt.Errorf("failed to lock filenames for owner: %w", err)
+	}
+	var existingID int
+	err := tx.QueryRow(ctx, "SELECT id FROM user_files WHERE owner_id = $1 AND filename = $2 ORDER BY id LIMIT 1", userID, filename).Scan(&existingID)
+	if err == pgx.ErrNoRows {
+		return filename, 0, "none", nil
+	}
+	if err != nil {
+		return "", 0, "", fmt.Errorf("failed to check for filename conflict: %w", err)
+	}
+	switch policy {
+	case conflictReject:
+		return "", 0, policy, errFilenameConflict
+	case conflictReplace:
+		return filename, existingID, policy, nil
+	}
+	for n := 1; ; n++ {
+		candidate := numberedFilename(filename, n)
+		var taken bool
+		if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM user_files WHERE owner_id = $1 AND filename = $2)", userID, candidate).Scan(&taken); err != nil {
+			return "", 0, "", fmt.Errorf("failed to check for filename conflict: %w", err)
+		}
+		if !taken {
+			return candidate, 0, policy, nil
+		}
+	}
+}
+
+// Orphaned blobs are returned rather than destroyed; the caller's tx may still roll back.
+func replaceUserFile(ctx context.Context, tx pgx.Tx, userFileID, newUserFileID int) ([]uploadedBlob, error) {
+	for _, table := range []string{"file_shares", "group_file_shares", "public_links", "access_requests"} {
+		if _, err := tx.Exec(ctx, "UPDATE "+table+" SET user_file_id = $2 WHERE user_file_id = $1", userFileID, newUserFileID); err != nil {
+			return nil, fmt.Errorf("failed to carry %s over to replacement file: %w", table, err)
+		}
+	}
+	var physicalFileID int
+	if err := tx.QueryRow(ctx, "UPDATE user_files nf SET is_public = old.is_public, download_count = old.download_count FROM user_files old WHERE nf.id = $2 AND old.id = $1 RETURNING old.physical_file_id", userFileID, newUserFileID).Scan(&physicalFileID); err != nil {
+		return nil, fmt.Errorf("failed to carry settings over to replacement file: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "DELETE FROM user_files WHERE id = $1", userFileID); err != nil {
+		return nil, fmt.Errorf("failed to delete replaced file reference: %w", err)
+	}
+	var refCount int
+	var publicID, mimeType string
+	if err := tx.QueryRow(ctx, "UPDATE physical_files SET ref_count = ref_count - 1 WHERE id = $1 RETURNING ref_count, public_id, mime_type", physicalFileID).Scan(&refCount, &publicID, &mimeType); err != nil {
+		return nil, fmt.Errorf("failed to update reference count for replaced file: %w", err)
+	}
+	if refCount > 0 {
+		return nil, nil
+	}
+	released := append(renditionBlobs(ctx, tx, physicalFileID), uploadedBlob{PublicID: publicID, ResourceType: getResourceTypeFromMIME(mimeType)})
+	if _, err := tx.Exec(ctx, "DELETE FROM physical_files WHERE id = $1", physicalFileID); err != nil {
+		return nil, fmt.Errorf("failed to delete replaced physical file record: %w", err)
+	}
+	return released, nil
+}
+
+type inspectedUpload struct {
+	Name            string
+	ContentMimeType string
+	ExtMimeType     string
+	FinalMimeType   string
+	MimeMismatch    bool
+	Scanned         bool
+	ScanStatus      string
+	ContentText     string
+	TextStatus      string
+}
+
+func inspectUpload(ctx context.Context, user *AuthenticatedUser, header *multipart.FileHeader, hashStr string) (*inspectedUpload, error) {
+	userID := user.ID
+	insp := &inspectedUpload{Name: sanitizeFilename(header.Filename)}
+	file, err := header.Open()
+	if err != nil {
+		return nil, fmt.Errorf("could not open file header: %w", err)
+	}
+	defer file.Close()
+	buffer := make([]byte, 512)
+	n, err := io.ReadFull(file, buffer)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("could not read file header for MIME detection: %w", err)
+	}
+	insp.ContentMimeType = detectContentMIME(buffer[:n])
+	insp.ExtMimeType = mime.TypeByExtension(filepath.Ext(insp.Name))
+	insp.FinalMimeType = insp.ExtMimeType
+	if insp.ExtMimeType == "" {
+		insp.FinalMimeType = insp.ContentMimeType
+	} else if !mimeTypesCompatible(insp.ExtMimeType, insp.ContentMimeType) {
+		insp.MimeMismatch = true
+		switch appConfig.MimeMismatchPolicy {
+		case mimePolicyReject:
+			logAuditEvent(ctx, userID, 0, "FILE_MIME_MISMATCH", map[string]interface{}{"filename": insp.Name, "extensionMimeType": insp.ExtMimeType, "detectedMimeType": insp.ContentMimeType, "policy": mimePolicyReject})
+			return nil, fmt.Errorf("%w: extension suggests %s but content is %s", errMimeMismatch, insp.ExtMimeType, insp.ContentMimeType)
+		case mimePolicyTrustContent:
+			insp.FinalMimeType = insp.ContentMimeType
+		}
+	}
+	for _, checkedType := range []string{insp.FinalMimeType, insp.ContentMimeType} {
+		if reason := evaluateMimePolicy(user.Role, checkedType, header.Size); reason != "" {
+			logAuditEvent(ctx, userID, 0, "FILE_POLICY_REJECTED", map[string]interface{}{"filename": insp.Name, "mimeType": checkedType, "size": header.Size, "role": user.Role})
+			return nil, fmt.Errorf("%w: %s", errMimePolicyViolation, reason)
+		}
+	}
+	var exists bool
+	if err := pool.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM physical_files WHERE hash = $1)", hashStr).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to check for existing file hash: %w", err)
+	}
+	if exists {
+		return insp, nil
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("could not seek file after MIME check: %w", err)
+	}
+	insp.Scanned = true
+	insp.ScanStatus = scanStatusPending
+	verdict, scanErr := scanner.Scan(ctx, file)
+	if scanErr != nil {
+		log.Printf("Malware scan failed for %s, leaving it pending: %v", hashStr, scanErr)
+	} else if !verdict.Clean {
+		logAuditEvent(ctx, userID, 0, "FILE_SCAN_INFECTED", map[string]interface{}{"filename": insp.Name, "hash": hashStr, "signature": verdict.Signature})
+		return nil, fmt.Errorf("%w: %s", errInfectedFile, verdict.Signature)
+	} else {
+		insp.ScanStatus = scanStatusClean
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		return nil, fmt.Errorf("could not seek file after malware scan: %w", err)
+	}
+	contentText, extractErr := extractDocumentText(ctx, file, header.Size, insp.FinalMimeType)
+	if extractErr != nil {
+		log.Printf("Text extraction failed for %s: %v", insp.Name, extractErr)
+	}
+	insp.ContentText, insp.TextStatus = contentText, textStatusFor(insp.FinalMimeType, extractErr)
+	return insp, nil
+}
+
+func processAndUploadFile(ctx context.Context, tx pgx.Tx, user *AuthenticatedUser, header *multipart.FileHeader, hashStr, conflictPolicy string, insp *inspectedUpload) (map[string]interface{}, *uploadedBlob, []uploadedBlob, error) {
+	userID := user.ID
+	filename, replaceID, appliedPolicy, err := resolveFilenameConflict(ctx, tx, userID, insp.Name, conflictPolicy)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	file, err := header.Open()
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not open file header: %w", err)
+	}
+	defer file.Close()
+	finalMimeType, contentMimeType, extMimeType, mimeMismatch := insp.FinalMimeType, insp.ContentMimeType, insp.ExtMimeType, insp.MimeMismatch
+	var physicalFileID int
+	var wasDeduplicated bool
+	var blob *uploadedBlob
+	var scanStatus string
+	err = tx.QueryRow(ctx, "SELECT id, scan_status FROM physical_files WHERE hash = $1", hashStr).Scan(&physicalFileID, &scanStatus)
+	if err == pgx.ErrNoRows {
+		wasDeduplicated = false
+		scanStatus = scanStatusPending
+		textStatus := textStatusPending
+		if insp.Scanned {
+			scanStatus, textStatus = insp.ScanStatus, insp.TextStatus
+		}
+		resourceType := getResourceTypeFromMIME(finalMimeType)
+		uploadParams := uploader.UploadParams{ResourceType: resourceType, Type: "upload", Moderation: "manual"}
+		uploadResult, uploadErr := cld.Upload.Upload(ctx, file, uploadParams)
+		if uploadErr != nil {
+			return nil, nil, nil, fmt.Errorf("cloudinary upload failed: %w", uploadErr)
+		}
+		blob = &uploadedBlob{PublicID: uploadResult.PublicID, ResourceType: resourceType}
+		insertErr := tx.QueryRow(ctx, `INSERT INTO physical_files (hash, storage_url, public_id, size, mime_type, detected_mime_type, scan_status, content_text, content_tsv, text_status) VALUES ($1, $2, $3, $4, $5, $6, $7, NULLIF($8, ''), CASE WHEN $8 = '' THEN NULL ELSE to_tsvector('english', $8) END, $9) RETURNING id`, hashStr, uploadResult.SecureURL, uploadResult.PublicID, header.Size, finalMimeType, contentMimeType, scanStatus, insp.ContentText, textStatus).Scan(&physicalFileID)
+		if insertErr != nil {
+			return nil, blob, nil, fmt.Errorf("failed to insert new physical file record: %w", insertErr)
+		}
+	} else if err != nil {
+		return nil, nil, nil, fmt.Errorf("failed to check for existing file hash: %w", err)
+	} else if scanStatus == scanStatusInfected {
+		logAuditEvent(ctx, userID, 0, "FILE_SCAN_INFECTED", map[string]interface{}{"filename": filename, "hash": hashStr, "deduplicated": true})
+		return nil, nil, nil, errInfectedFile
+	} else {
+		wasDeduplicated = true
+		_, updateErr := tx.Exec(ctx, "UPDATE physical_files SET ref_count = ref_count + 1 WHERE id = $1", physicalFileID)
+		if updateErr != nil {
+			return nil, nil, nil, fmt.Errorf("failed to update reference count for duplicate file: %w", updateErr)
+		}
+	}
+	var userFileID int
+	var uploadedAt time.Time
+	err = tx.QueryRow(ctx, `INSERT INTO user_files (owner_id, physical_file_id, filename, mime_mismatch) VALUES ($1, $2, $3, $4) RETURNING id, uploaded_at`, userID, physicalFileID, filename, mimeMismatch).Scan(&userFileID, &uploadedAt)
+	if err != nil {
+		return nil, blob, nil, fmt.Errorf("failed to create user file reference: %w", err)
+	}
+	var released []uploadedBlob
+	if replaceID != 0 {
+		if released, err = replaceUserFile(ctx, tx, replaceID, userFileID); err != nil {
+			return nil, blob, nil, err
+		}
+	}
+	result := map[string]interface{}{"userFileId": userFileID, "filename": filename, "size": header.Size, "uploadedAt": uploadedAt, "wasDeduplicated": wasDeduplicated, "conflictPolicy": appliedPolicy, "scanStatus": scanStatus}
+	if replaceID != 0 {
+		result["replacedFileId"] = replaceID
+	}
+	if filename != header.Filename {
+		result["originalFilename"] = strings.ToValidUTF8(strings.ReplaceAll(header.Filename, "\x00", ""), "")
+	}
+	if mimeMismatch {
+		result["mimeMismatch"] = map[string]interface{}{"extensionMimeType": extMimeType, "detectedMimeType": contentMimeType, "policy": appConfig.MimeMismatchPolicy}
+	}
+	return result, blob, released, nil
+}
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 200
+	sortByRelevance  = "relevance"
+)
+
+type sortColumn struct {
+	Expr string
+	Cast string
+}
+
+var fileSortColumns = map[string]sortColumn{
+	"name":          {"uf.filename", "text"},
+	"size":          {"pf.size", "bigint"},
+	"uploadedAt":    {"uf.uploaded_at", "timestamptz"},
+	"downloadCount": {"uf.download_count", "int"},
+}
+
+var auditLogSortColumns = map[string]sortColumn{
+	"createdAt": {"created_at", "timestamptz"},
+}
+
+type PageParams struct {
+	Limit   int    `json:"limit"`
+	Cursor  string `json:"cursor"`
+	SortBy  string `json:"sortBy"`
+	SortDir string `json:"sortDir"`
+	unpaged bool
+}
+
+type pageCursor struct {
+	SortBy  string    `json:"s"`
+	SortDir string    `json:"d"`
+	Value   string    `json:"v,omitempty"`
+	ID      int64     `json:"id,omitempty"`
+	Scores  []float64 `json:"r,omitempty"`
+}
+
+type PageResponse struct {
+	Items      interface{} `json:"items"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	HasMore    bool        `json:"hasMore"`
+	Limit      int         `json:"limit"`
+}
+
+func pageParamsFromQuery(r *http.Request) PageParams {
+	q := r.URL.Query()
+	limit, _ := strconv.Atoi(q.Get("limit"))
+	return PageParams{Limit: limit, Cursor: q.Get("cursor"), SortBy: q.Get("sortBy"), SortDir: q.Get("sortDir")}
+}
+
+func (p *PageParams) normalize(columns map[string]sortColumn, defaultSort string, allowRelevance bool) error {
+	p.unpaged = p.Limit <= 0 && p.Cursor == ""
+	if p.Limit <= 0 {
+		p.Limit = defaultPageLimit
+	}
+	if p.Limit > maxPageLimit {
+		p.Limit = maxPageLimit
+	}
+	if p.SortBy == "" {
+		p.SortBy = defaultSort
+	}
+	if _, ok := columns[p.SortBy]; !ok && !(allowRelevance && p.SortBy == sortByRelevance) {
+		return fmt.Errorf("invalid sortBy %q", p.SortBy)
+	}
+	p.SortDir = strings.ToLower(p.SortDir)
+	if p.SortDir == "" {
+		p.SortDir = "desc"
+	}
+	if p.SortDir != "asc" && p.SortDir != "desc" {
+		return fmt.Errorf("invalid sortDir %q, use asc or desc", p.SortDir)
+	}
+	return nil
+}
+
+func (p PageParams) decodeCursor() (*pageCursor, error) {
+	if p.Cursor == "" {
+		return nil, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(p.Cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var c pageCursor
+	if err := json.Unmarshal(raw, &c); err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	if c.SortBy != p.SortBy || c.SortDir != p.SortDir {
+		return nil, errors.New("cursor does not match the requested sort order")
+	}
+	return &c, nil
+}
+
+func encodeCursor(c pageCursor) string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func (p PageParams) keysetClause(columns map[string]sortColumn, idExpr string, argID int, relevanceExprs []string) (string, string, string, []interface{}, error) {
+	cursor, err := p.decodeCursor()
+	if err != nil {
+		return "", "", "", nil, err
+	}
+	limitClause := fmt.Sprintf(" LIMIT %d", p.Limit+1)
+	if p.unpaged {
+		limitClause = ""
+	}
+	if p.SortBy == sortByRelevance {
+		var orderTerms []string
+		for _, expr := range relevanceExprs {
+			orderTerms = append(orderTerms, expr+" DESC")
+		}
+		orderBy := strings.Join(append(orderTerms, idExpr+" DESC"), ", ")
+		if cursor == nil {
+			return "", orderBy, limitClause, nil, nil
+		}
+		if len(cursor.Scores) != len(relevanceExprs) {
+			return "", "", "", nil, errors.New("cursor does not match the requested search")
+		}
+		var placeholders []string
+		var args []interface{}
+		for i, score := range cursor.Scores {
+			placeholders = append(placeholders, fmt.Sprintf("$%d::float8", argID+i))
+			args = append(args, score)
+		}
+		placeholders = append(placeholders, fmt.Sprintf("$%d", argID+len(cursor.Scores)))
+		args = append(args, cursor.ID)
+		condition := fmt.Sprintf("(%s, %s) < (%s)", strings.Join(relevanceExprs, ", "), idExpr, strings.Join(placeholders, ", "))
+		return condition, orderBy, limitClause, args, nil
+	}
+	col := columns[p.SortBy]
+	orderBy := fmt.Sprintf("%s %s, %s %s", col.Expr, p.SortDir, idExpr, p.SortDir)
+	if cursor == nil {
+		return "", orderBy, limitClause, nil, nil
+	}
+	op := "<"
+	if p.SortDir == "asc" {
+		op = ">"
+	}
+	condition := fmt.Sprintf("(%s, %s) %s ($%d::%s, $%d)", col.Expr, idExpr, op, argID, col.Cast, argID+1)
+	return condition, orderBy, limitClause, []interface{}{cursor.Value, cursor.ID}, nil
+}
+
+func (p PageParams) hasMoreRows(n int) bool {
+	return !p.unpaged && n > p.Limit
+}
+
+// Unpaged callers keep the original bare-array response.
+func writePage(w http.ResponseWriter, p PageParams, page PageResponse) {
+	if p.unpaged {
+		writeJSON(w, http.StatusOK, page.Items)
+		return
+	}
+	writeJSON(w, http.StatusOK, page)
+}
+
+func (p PageParams) nextCursor(value string, id int64, scores []float64) string {
+	if p.SortBy == sortByRelevance {
+		return encodeCursor(pageCursor{SortBy: p.SortBy, SortDir: p.SortDir, ID: id, Scores: scores})
+	}
+	return encodeCursor(pageCursor{SortBy: p.SortBy, SortDir: p.SortDir, Value: value, ID: id})
+}
+
+func relevanceScores(scores ...*float64) []float64 {
+	var values []float64
+	for _, score := range scores {
+		if score != nil {
+			values = append(values, *score)
+		}
+	}
+	return values
+}
+
+func fileCursorValue(sortBy, filename string, size int64, uploadedAt time.Time, downloadCount int) string {
+	switch sortBy {
+	case "name":
+		return filename
+	case "size":
+		return strconv.FormatInt(size, 10)
+	case "downloadCount":
+		return strconv.Itoa(downloadCount)
+	}
+	return uploadedAt.Format(time.RFC3339Nano)
+}
+
+func fuzzyMatchCondition(column string, argID int) string {
+	return fmt.Sprintf("(%[1]s %% $%[2]d OR $%[2]d <%% %[1]s OR %[1]s ILIKE '%%' || $%[2]d || '%%')", column, argID)
+}
+
+func fuzzySimilarityExpr(column string, argID int) string {
+	return fmt.Sprintf("GREATEST(similarity(%[1]s, $%[2]d), word_similarity($%[2]d, %[1]s))", column, argID)
+}
+
+type QuerySyntaxError struct {
+	Position int
+	Token    string
+	Message  string
+}
+
+func (e *QuerySyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d near %q", e.Message, e.Position, e.Token)
+}
+
+type queryToken struct {
+	Text     string
+	Position int
+}
+
+var querySizePattern = regexp.MustCompile(`(?i)^(\d+(?:\.\d+)?)(b|kb|mb|gb|tb)?$`)
+
+var querySizeUnits = map[string]float64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40}
+
+func tokenizeSearchQuery(q string) ([]queryToken, error) {
+	var tokens []queryToken
+	runes := []rune(q)
+	for i := 0; i < len(runes); {
+		if unicode.IsSpace(runes[i]) {
+			i++
+			continue
+		}
+		start := i
+		inQuote, quoteStart := false, 0
+		for i < len(runes) && (inQuote || !unicode.IsSpace(runes[i])) {
+			if runes[i] == '"' {
+				inQuote = !inQuote
+				quoteStart = i
+			}
+			i++
+		}
+		if inQuote {
+			return nil, &QuerySyntaxError{Position: quoteStart, Token: string(runes[quoteStart:]), Message: "unterminated quote"}
+		}
+		tokens = append(tokens, queryToken{Text: string(runes[start:i]), Position: start})
+	}
+	return tokens, nil
+}
+
+func unquoteQueryValue(value string) string {
+	if len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`) {
+		return value[1 : len(value)-1]
+	}
+	return value
+}
+
+func splitQueryTerm(text string) (string, string, string) {
+	if strings.HasPrefix(text, `"`) {
+		return "", "", text
+	}
+	idx := strings.IndexAny(text, ":<>=")
+	if idx <= 0 {
+		return "", "", text
+	}
+	key, rest := strings.ToLower(text[:idx]), text[idx:]
+	for _, op := range []string{">=", "<=", ":", ">", "<", "="} {
+		if strings.HasPrefix(rest, op) {
+			return key, op, rest[len(op):]
+		}
+	}
+	return "", "", text
+}
+
+const likeEscapeClause = ` ESCAPE '\'`
+
+var likePatternEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func escapeLikePattern(value string) string {
+	return likePatternEscaper.Replace(value)
+}
+
+func likeContainsPattern(value string) string {
+	return "%" + escapeLikePattern(value) + "%"
+}
+
+func parseRelativeQueryDate(value string, now time.Time) (time.Time, bool) {
+	if len(value) < 3 || value[0] != '-' {
+		return time.Time{}, false
+	}
+	n, err := strconv.Atoi(value[1 : len(value)-1])
+	if err != nil || n <= 0 {
+		return time.Time{}, false
+	}
+	switch value[len(value)-1] {
+	case 'd':
+		return now.AddDate(0, 0, -n), true
+	case 'w':
+		return now.AddDate(0, 0, -7*n), true
+	case 'm':
+		return now.AddDate(0, -n, 0), true
+	case 'y':
+		return now.AddDate(-n, 0, 0), true
+	}
+	return time.Time{}, false
+}
+
+// Conditions share runFileSearch's placeholder numbering; $1 is the caller's ID.
+func compileSearchQuery(q string, argID int) ([]string, []interface{}, int, error) {
+	tokens, err := tokenizeSearchQuery(q)
+	if err != nil {
+		return nil, nil, argID, err
+	}
+	var conditions []string
+	var args []interface{}
+	addArg := func(v interface{}) string {
+		args = append(args, v)
+		argID++
+		return fmt.Sprintf("$%d", argID-1)
+	}
+	for _, tok := range tokens {
+		fail := func(message string) error {
+			return &QuerySyntaxError{Position: tok.Position, Token: tok.Text, Message: message}
+		}
+		key, op, value := splitQueryTerm(tok.Text)
+		value = unquoteQueryValue(value)
+		if key == "" {
+			if value == "" {
+				return nil, nil, argID, fail("empty search term")
+			}
+			conditions = append(conditions, "uf.filename ILIKE "+addArg(likeContainsPattern(value))+likeEscapeClause)
+			continue
+		}
+		if value == "" {
+			return nil, nil, argID, fail(fmt.Sprintf("missing value for %s", key))
+		}
+		if key != "size" && op != ":" {
+			return nil, nil, argID, fail(fmt.Sprintf("%s only supports ':'", key))
+		}
+		switch key {
+		case "name":
+			conditions = append(conditions, "uf.filename ILIKE "+addArg(likeContainsPattern(value))+likeEscapeClause)
+		case "type":
+			var typeConditions []string
+			for _, v := range strings.Split(value, ",") {
+				v = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(v), "."))
+				if v == "" {
+					return nil, nil, argID, fail("empty type in list")
+				}
+				if strings.Contains(v, "/") {
+					typeConditions = append(typeConditions, baseMIMEExpr+" LIKE "+addArg(mimeLikePatterns([]string{v})[0]))
+				} else if mimeType := mime.TypeByExtension("." + v); mimeType != "" {
+					typeConditions = append(typeConditions, fmt.Sprintf("uf.filename ILIKE %s%s OR %s = %s", addArg("%."+escapeLikePattern(v)), likeEscapeClause, baseMIMEExpr, addArg(baseMIME(mimeType))))
+				} else {
+					typeConditions = append(typeConditions, "uf.filename ILIKE "+addArg("%."+escapeLikePattern(v))+likeEscapeClause)
+				}
+			}
+			conditions = append(conditions, "("+strings.Join(typeConditions, " OR ")+")")
+		case "category":
+			mimePatterns, extensions, err := categoryPatterns(strings.Split(value, ","))
+			if err != nil {
+				return nil, nil, argID, fail(err.Error())
+			}
+			conditions = append(conditions, fmt.Sprintf("(%s LIKE ANY(%s) OR LOWER(uf.filename) LIKE ANY(%s))", baseMIMEExpr, addArg(mimePatterns), addArg(extensions)))
+		case "size":
+			m := querySizePattern.FindStringSubmatch(value)
+			if m == nil {
+				return nil, nil, argID, fail("invalid size, expected a number with an optional B/KB/MB/GB/TB unit")
+			}
+			n, _ := strconv.ParseFloat(m[1], 64)
+			sqlOp := op
+			if op == ":" {
+				sqlOp = "="
+			}
+			conditions = append(conditions, fmt.Sprintf("pf.size %s %s", sqlOp, addArg(int64(n*querySizeUnits[strings.ToLower(m[2])]))))
+		case "owner":
+			if strings.EqualFold(value, "me") {
+				conditions = append(conditions, "uf.owner_id = $1")
+				continue
+			}
+			pattern := addArg(likeContainsPattern(value))
+			conditions = append(conditions, fmt.Sprintf("(u_owner.username ILIKE %[1]s%[2]s OR u_owner.name ILIKE %[1]s%[2]s)", pattern, likeEscapeClause))
+		case "shared":
+			switch strings.ToLower(value) {
+			case "yes", "true":
+				conditions = append(conditions, "uf.owner_id <> $1")
+			case "no", "false":
+				conditions = append(conditions, "uf.owner_id = $1")
+			default:
+				return nil, nil, argID, fail("shared expects yes or no")
+			}
+		case "before", "after":
+			if at, ok := parseRelativeQueryDate(value, time.Now()); ok {
+				if key == "before" {
+					conditions = append(conditions, "uf.uploaded_at < "+addArg(at))
+				} else {
+					conditions = append(conditions, "uf.uploaded_at >= "+addArg(at))
+				}
+				break
+			}
+			day, err := time.Parse("2006-01-02", value)
+			if err != nil {
+				return nil, nil, argID, fail("invalid date, expected YYYY-MM-DD or a relative offset like -7d")
+			}
+			if key == "before" {
+				conditions = append(conditions, "uf.uploaded_at < "+addArg(day))
+			} else {
+				conditions = append(conditions, "uf.uploaded_at >= "+addArg(day.AddDate(0, 0, 1)))
+			}
+		case "content":
+			conditions = append(conditions, "pf.content_tsv @@ websearch_to_tsquery('english', "+addArg(value)+")")
+		default:
+			return nil, nil, argID, fail(fmt.Sprintf("unknown field %q", key))
+		}
+	}
+	return conditions, args, argID, nil
+}
+
+type SearchFilters struct {
+	Filename  *string    `json:"filename,omitempty"`
+	OwnerName *string    `json:"ownerName,omitempty"`
+	MimeType  *string    `json:"mimeType,omitempty"`
+	MinSize   *int64     `json:"minSize,omitempty"`
+	MaxSize   *int64     `json:"maxSize,omitempty"`
+	StartDate *time.Time `json:"startDate,omitempty"`
+	EndDate   *time.Time `json:"endDate,omitempty"`
+	Content   *string    `json:"content,omitempty"`
+	Fuzzy     bool       `json:"fuzzy,omitempty"`
+
+	MimeTypes  []string `json:"mimeTypes,omitempty"`
+	Categories []string `json:"categories,omitempty"`
+	Extensions []string `json:"extensions,omitempty"`
+	OwnerNames []string `json:"ownerNames,omitempty"`
+}
+
+type SearchRequest struct {
+	Filters SearchFilters `json:"filters"`
+	Q       string        `json:"q"`
+	PageParams
+}
+
+func writeSearchQueryError(w http.ResponseWriter, err error) {
+	var syntaxErr *QuerySyntaxError
+	if errors.As(err, &syntaxErr) {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": "Invalid search query: " + syntaxErr.Error(), "position": syntaxErr.Position, "token": syntaxErr.Token})
+		return
+	}
+	writeError(w, http.StatusBadRequest, "Invalid search query")
+}
+
+// Escaped so the <mark> tags ts_headline adds are the only markup in a snippet.
+const escapedContentTextExpr = `replace(replace(replace(replace(pf.content_text, '&', '&amp;'), '<', '&lt;'), '>', '&gt;'), '"', '&quot;')`
+
+func searchFilesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req SearchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body for searching/filtering")
+		return
+	}
+	runFileSearch(w, r, user, req)
+}
+
+func searchRelevance(req SearchRequest) (string, bool) {
+	var terms []string
+	if req.Filters.Content != nil && strings.TrimSpace(*req.Filters.Content) != "" {
+		terms = append(terms, strings.TrimSpace(*req.Filters.Content))
+	}
+	if tokens, err := tokenizeSearchQuery(req.Q); err == nil {
+		for _, tok := range tokens {
+			if key, _, value := splitQueryTerm(tok.Text); key == "content" && unquoteQueryValue(value) != "" {
+				terms = append(terms, unquoteQueryValue(value))
+			}
+		}
+	}
+	contentQuery := strings.Join(terms, " ")
+	fuzzy := req.Filters.Fuzzy && ((req.Filters.Filename != nil && *req.Filters.Filename != "") || (req.Filters.OwnerName != nil && *req.Filters.OwnerName != ""))
+	return contentQuery, contentQuery != "" || fuzzy
+}
+
+func runFileSearch(w http.ResponseWriter, r *http.Request, user *AuthenticatedUser, req SearchRequest) {
+	ctx := r.Context()
+	contentQuery, hasRelevance := searchRelevance(req)
+	defaultSort := "uploadedAt"
+	if hasRelevance {
+		defaultSort = sortByRelevance
+	}
+	if err := req.PageParams.normalize(fileSortColumns, defaultSort, hasRelevance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	args := []interface{}{user.ID}
+	conditions := []string{}
+	argID := 2
+	rankExpr, snippetExpr, similarityExpr := "NULL::float8", "NULL::text", "NULL::float8"
+	var orderTerms, similarityTerms []string
+	if contentQuery != "" {
+		tsQuery := fmt.Sprintf("websearch_to_tsquery('english', $%d)", argID)
+		conditions = append(conditions, "pf.content_tsv @@ "+tsQuery)
+		rankExpr = fmt.Sprintf("ts_rank(pf.content_tsv, %s)::float8", tsQuery)
+		snippetExpr = fmt.Sprintf("ts_headline('english', "+escapedContentTextExpr+", %s, 'StartSel=<mark>, StopSel=</mark>, MaxWords=25, MinWords=8, MaxFragments=2')", tsQuery)
+		orderTerms = append(orderTerms, rankExpr)
+		args = append(args, contentQuery)
+		argID++
+	}
+	if req.Filters.Filename != nil && *req.Filters.Filename != "" {
+		if req.Filters.Fuzzy {
+			conditions = append(conditions, fuzzyMatchCondition("uf.filename", argID))
+			similarityTerms = append(similarityTerms, fuzzySimilarityExpr("uf.filename", argID))
+			args = append(args, *req.Filters.Filename)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("uf.filename ILIKE $%d", argID))
+			args = append(args, "%"+*req.Filters.Filename+"%")
+		}
+		argID++
+	}
+	if req.Filters.OwnerName != nil && *req.Filters.OwnerName != "" {
+		if req.Filters.Fuzzy {
+			conditions = append(conditions, fuzzyMatchCondition("u_owner.name", argID))
+			similarityTerms = append(similarityTerms, fuzzySimilarityExpr("u_owner.name", argID))
+			args = append(args, *req.Filters.OwnerName)
+		} else {
+			conditions = append(conditions, fmt.Sprintf("u_owner.name ILIKE $%d", argID))
+			args = append(args, "%"+*req.Filters.OwnerName+"%")
+		}
+		argID++
+	}
+	if len(similarityTerms) > 0 {
+		similarityExpr = "GREATEST(" + strings.Join(similarityTerms, ", ") + ")::float8"
+		orderTerms = append(orderTerms, similarityExpr)
+	}
+	orderTerms = append(orderTerms, "uf.uploaded_at DESC")
+	baseQuery := fmt.Sprintf(`SELECT uf.id, uf.filename, pf.size, pf.mime_type, uf.is_public, uf.download_count, uf.uploaded_at, pf.storage_url, u_owner.name AS owner_name, pf.ref_count, CASE WHEN uf.owner_id = $1 THEN NULL ELSE u_owner.name END AS shared_by, %s AS permission, %s AS rank, %s AS snippet, %s AS similarity FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id WHERE (uf.owner_id = $1 OR %s IS NOT NULL)`, sharePermissionExpr("uf.id", "$1"), rankExpr, snippetExpr, similarityExpr, sharePermissionExpr("uf.id", "$1"))
+	if req.Filters.MimeType != nil && *req.Filters.MimeType != "" {
+		conditions = append(conditions, fmt.Sprintf("%s = $%d", baseMIMEExpr, argID))
+		args = append(args, baseMIME(*req.Filters.MimeType))
+		argID++
+	}
+	if patterns := mimeLikePatterns(req.Filters.MimeTypes); len(patterns) > 0 {
+		conditions = append(conditions, fmt.Sprintf("%s LIKE ANY($%d)", baseMIMEExpr, argID))
+		args = append(args, patterns)
+		argID++
+	}
+	if len(req.Filters.Categories) > 0 {
+		mimePatterns, extensions, err := categoryPatterns(req.Filters.Categories)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s LIKE ANY($%d) OR LOWER(uf.filename) LIKE ANY($%d))", baseMIMEExpr, argID, argID+1))
+		args = append(args, mimePatterns, extensions)
+		argID += 2
+	}
+	if patterns := extensionLikePatterns(req.Filters.Extensions); len(patterns) > 0 {
+		conditions = append(conditions, fmt.Sprintf("LOWER(uf.filename) LIKE ANY($%d)", argID))
+		args = append(args, patterns)
+		argID++
+	}
+	if len(req.Filters.OwnerNames) > 0 {
+		owners := make([]string, 0, len(req.Filters.OwnerNames))
+		for _, o := range req.Filters.OwnerNames {
+			if o = strings.ToLower(strings.TrimSpace(o)); o != "" {
+				owners = append(owners, o)
+			}
+		}
+		if len(owners) > 0 {
+			conditions = append(conditions, fmt.Sprintf("(LOWER(u_owner.username) = ANY($%d) OR LOWER(u_owner.name) = ANY($%d))", argID, argID))
+			args = append(args, owners)
+			argID++
+		}
 	}
 	if req.Filters.MinSize != nil {
 		conditions = append(conditions, fmt.Sprintf("pf.size >= $%d", argID))
 		args = append(args, *req.Filters.MinSize)
 		argID++
 	}
-	if req.Filters.MaxSize != nil {
-		conditions = append(conditions, fmt.Sprintf("pf.size <= $%d", argID))
-		args = append(args, *req.Filters.MaxSize)
-		argID++
+	if req.Filters.MaxSize != nil {
+		conditions = append(conditions, fmt.Sprintf("pf.size <= $%d", argID))
+		args = append(args, *req.Filters.MaxSize)
+		argID++
+	}
+	if req.Filters.StartDate != nil {
+		conditions = append(conditions, fmt.Sprintf("uf.uploaded_at >= $%d", argID))
+		args = append(args, *req.Filters.StartDate)
+		argID++
+	}
+	if req.Filters.EndDate != nil {
+		conditions = append(conditions, fmt.Sprintf("uf.uploaded_at <= $%d", argID))
+		args = append(args, *req.Filters.EndDate)
+		argID++
+	}
+	qConditions, qArgs, argID, err := compileSearchQuery(req.Q, argID)
+	if err != nil {
+		writeSearchQueryError(w, err)
+		return
+	}
+	conditions = append(conditions, qConditions...)
+	args = append(args, qArgs...)
+	pageCondition, orderBy, limitClause, pageArgs, err := req.PageParams.keysetClause(fileSortColumns, "uf.id", argID, orderTerms)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if pageCondition != "" {
+		conditions = append(conditions, pageCondition)
+		args = append(args, pageArgs...)
+	}
+	finalQuery := baseQuery
+	if len(conditions) > 0 {
+		finalQuery += " AND " + strings.Join(conditions, " AND ")
+	}
+	finalQuery += ` ORDER BY ` + orderBy + limitClause
+	rows, err := pool.Query(ctx, finalQuery, args...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query files: "+err.Error())
+		return
+	}
+	defer rows.Close()
+	type FileInfo struct {
+		ID            int        `json:"id"`
+		Filename      string     `json:"filename"`
+		Size          int64      `json:"size"`
+		MimeType      string     `json:"mimeType"`
+		IsPublic      bool       `json:"isPublic"`
+		DownloadCount int        `json:"downloadCount"`
+		UploadedAt    time.Time  `json:"uploadedAt"`
+		URL           string     `json:"url"`
+		OwnerName     string     `json:"ownerName"`
+		RefCount      int        `json:"refCount"`
+		SharedBy      *string    `json:"sharedBy,omitempty"`
+		Permission    *string    `json:"permission,omitempty"`
+		Rank          *float64   `json:"rank,omitempty"`
+		Snippet       *string    `json:"snippet,omitempty"`
+		Similarity    *float64   `json:"similarity,omitempty"`
+	}
+	var files []FileInfo
+	for rows.Next() {
+		var f FileInfo
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Size, &f.MimeType, &f.IsPublic, &f.DownloadCount, &f.UploadedAt, &f.URL, &f.OwnerName, &f.RefCount, &f.SharedBy, &f.Permission, &f.Rank, &f.Snippet, &f.Similarity); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan file data: "+err.Error())
+			return
+		}
+		f.URL = sanitizeCloudinaryURL(f.URL)
+		files = append(files, f)
+	}
+	page := PageResponse{Items: []FileInfo{}, Limit: req.Limit}
+	if req.PageParams.hasMoreRows(len(files)) {
+		files = files[:req.Limit]
+		last := files[len(files)-1]
+		page.HasMore = true
+		page.NextCursor = req.PageParams.nextCursor(fileCursorValue(req.SortBy, last.Filename, last.Size, last.UploadedAt, last.DownloadCount), int64(last.ID), relevanceScores(last.Rank, last.Similarity))
+	}
+	if files != nil {
+		page.Items = files
+	}
+	writePage(w, req.PageParams, page)
+}
+
+type SavedSearchDefinition struct {
+	Filters SearchFilters `json:"filters"`
+	Q       string        `json:"q"`
+	SortBy  string        `json:"sortBy,omitempty"`
+	SortDir string        `json:"sortDir,omitempty"`
+}
+
+type SavedSearch struct {
+	ID         int                   `json:"id"`
+	Name       string                `json:"name"`
+	Definition SavedSearchDefinition `json:"definition"`
+	Pinned     bool                  `json:"pinned"`
+	Position   *int                  `json:"position,omitempty"`
+	CreatedAt  time.Time             `json:"createdAt"`
+	UpdatedAt  time.Time             `json:"updatedAt"`
+}
+
+const maxSavedSearchNameLength = 100
+
+func validateSavedSearch(w http.ResponseWriter, name string, def *SavedSearchDefinition) bool {
+	if name == "" || len(name) > maxSavedSearchNameLength {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("Name is required and must be at most %d characters", maxSavedSearchNameLength))
+		return false
+	}
+	if _, _, _, err := compileSearchQuery(def.Q, 2); err != nil {
+		writeSearchQueryError(w, err)
+		return false
+	}
+	if _, _, err := categoryPatterns(def.Filters.Categories); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	def.SortDir = strings.ToLower(def.SortDir)
+	req := SearchRequest{Filters: def.Filters, Q: def.Q, PageParams: PageParams{SortBy: def.SortBy, SortDir: def.SortDir}}
+	_, hasRelevance := searchRelevance(req)
+	defaultSort := "uploadedAt"
+	if hasRelevance {
+		defaultSort = sortByRelevance
+	}
+	if err := req.PageParams.normalize(fileSortColumns, defaultSort, hasRelevance); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+func scanSavedSearch(row pgx.Row) (SavedSearch, error) {
+	var s SavedSearch
+	var definition []byte
+	if err := row.Scan(&s.ID, &s.Name, &definition, &s.Pinned, &s.Position, &s.CreatedAt, &s.UpdatedAt); err != nil {
+		return s, err
+	}
+	if err := json.Unmarshal(definition, &s.Definition); err != nil {
+		return s, fmt.Errorf("corrupt saved search definition: %w", err)
+	}
+	return s, nil
+}
+
+const savedSearchColumns = `id, name, definition, pinned, position, created_at, updated_at`
+
+func listSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	rows, err := pool.Query(ctx, `SELECT `+savedSearchColumns+` FROM saved_searches WHERE user_id = $1 ORDER BY pinned DESC, position ASC NULLS LAST, LOWER(name)`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query saved searches")
+		return
+	}
+	defer rows.Close()
+	searches := []SavedSearch{}
+	for rows.Next() {
+		s, err := scanSavedSearch(rows)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan saved search: "+err.Error())
+			return
+		}
+		searches = append(searches, s)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"collections": searches})
+}
+
+func createSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		Name       string                `json:"name"`
+		Definition SavedSearchDefinition `json:"definition"`
+		Pinned     bool                  `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validateSavedSearch(w, req.Name, &req.Definition) {
+		return
+	}
+	definition, _ := json.Marshal(req.Definition)
+	row := pool.QueryRow(ctx, `INSERT INTO saved_searches (user_id, name, definition, pinned, position) VALUES ($1, $2, $3, $4, CASE WHEN $4 THEN (SELECT COALESCE(MAX(position), -1) + 1 FROM saved_searches WHERE user_id = $1 AND pinned) END) RETURNING `+savedSearchColumns, user.ID, req.Name, definition, req.Pinned)
+	saved, err := scanSavedSearch(row)
+	if err != nil {
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "A saved search with this name already exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to save search")
+		return
+	}
+	logAuditEvent(ctx, user.ID, saved.ID, "SAVED_SEARCH_CREATE", map[string]interface{}{"name": saved.Name})
+	writeJSON(w, http.StatusCreated, saved)
+}
+
+func updateSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	searchID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return
+	}
+	var req struct {
+		Name       string                `json:"name"`
+		Definition SavedSearchDefinition `json:"definition"`
+		Pinned     bool                  `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if !validateSavedSearch(w, req.Name, &req.Definition) {
+		return
+	}
+	definition, _ := json.Marshal(req.Definition)
+	row := pool.QueryRow(ctx, `UPDATE saved_searches SET name = $3, definition = $4, pinned = $5, position = CASE WHEN NOT $5 THEN NULL WHEN pinned THEN position ELSE (SELECT COALESCE(MAX(position), -1) + 1 FROM saved_searches WHERE user_id = $2 AND pinned) END, updated_at = NOW() WHERE id = $1 AND user_id = $2 RETURNING `+savedSearchColumns, searchID, user.ID, req.Name, definition, req.Pinned)
+	saved, err := scanSavedSearch(row)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "A saved search with this name already exists")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to update saved search")
+		return
+	}
+	logAuditEvent(ctx, user.ID, saved.ID, "SAVED_SEARCH_UPDATE", map[string]interface{}{"name": saved.Name})
+	writeJSON(w, http.StatusOK, saved)
+}
+
+func deleteSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	searchID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return
+	}
+	var name string
+	err = pool.QueryRow(ctx, `DELETE FROM saved_searches WHERE id = $1 AND user_id = $2 RETURNING name`, searchID, user.ID).Scan(&name)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to delete saved search")
+		return
+	}
+	logAuditEvent(ctx, user.ID, searchID, "SAVED_SEARCH_DELETE", map[string]interface{}{"name": name})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Saved search deleted"})
+}
+
+// Searches left out of the list are unpinned.
+func reorderSavedSearchesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.IDs == nil {
+		req.IDs = []int{}
+	}
+	seen := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		if seen[id] {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Saved search %d listed more than once", id))
+			return
+		}
+		seen[id] = true
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var owned int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM saved_searches WHERE user_id = $1 AND id = ANY($2)`, user.ID, req.IDs).Scan(&owned); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to verify saved searches")
+		return
+	}
+	if owned != len(req.IDs) {
+		writeError(w, http.StatusNotFound, "One or more saved searches not found")
+		return
+	}
+	if _, err := tx.Exec(ctx, `UPDATE saved_searches SET pinned = FALSE, position = NULL WHERE user_id = $1 AND pinned AND NOT (id = ANY($2))`, user.ID, req.IDs); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update sidebar order")
+		return
+	}
+	for position, id := range req.IDs {
+		if _, err := tx.Exec(ctx, `UPDATE saved_searches SET pinned = TRUE, position = $3 WHERE id = $1 AND user_id = $2`, id, user.ID, position); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to update sidebar order")
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	listSavedSearchesHandler(w, r)
+}
+
+func runSavedSearchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	searchID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid saved search ID")
+		return
+	}
+	saved, err := scanSavedSearch(pool.QueryRow(ctx, `SELECT `+savedSearchColumns+` FROM saved_searches WHERE id = $1 AND user_id = $2`, searchID, user.ID))
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Saved search not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to load saved search")
+		return
+	}
+	page := pageParamsFromQuery(r)
+	req := SearchRequest{Filters: saved.Definition.Filters, Q: saved.Definition.Q, PageParams: PageParams{Limit: page.Limit, Cursor: page.Cursor, SortBy: saved.Definition.SortBy, SortDir: saved.Definition.SortDir}}
+	runFileSearch(w, r, user, req)
+}
+
+func listMySharedFilesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	params := pageParamsFromQuery(r)
+	if err := params.normalize(fileSortColumns, "uploadedAt", false); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageCondition, orderBy, limitClause, pageArgs, err := params.keysetClause(fileSortColumns, "uf.id", 2, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := `SELECT uf.id, uf.filename, pf.size, pf.mime_type, uf.is_public, uf.download_count, uf.uploaded_at, pf.storage_url, u_owner.name AS owner_name, COALESCE((SELECT jsonb_agg(jsonb_build_object('id', u_recipient.id, 'username', u_recipient.username, 'name', u_recipient.name, 'permission', fs.permission, 'expiresAt', fs.expires_at, 'status', fs.status)) FROM file_shares fs JOIN users u_recipient ON fs.recipient_id = u_recipient.id WHERE fs.user_file_id = uf.id AND ` + unexpiredShareCondition + `), '[]'::jsonb) AS shared_with, COALESCE((SELECT jsonb_agg(jsonb_build_object('id', g.id, 'name', g.name, 'permission', gs.permission)) FROM group_file_shares gs JOIN user_groups g ON gs.group_id = g.id WHERE gs.user_file_id = uf.id), '[]'::jsonb) AS shared_with_groups FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id WHERE uf.owner_id = $1 AND (uf.is_public = TRUE OR EXISTS (SELECT 1 FROM file_shares fs WHERE fs.user_file_id = uf.id AND ` + unexpiredShareCondition + `) OR EXISTS (SELECT 1 FROM group_file_shares gs WHERE gs.user_file_id = uf.id))`
+	if pageCondition != "" {
+		query += " AND " + pageCondition
+	}
+	query += ` ORDER BY ` + orderBy + limitClause
+	rows, err := pool.Query(ctx, query, append([]interface{}{user.ID}, pageArgs...)...)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query shared files: "+err.Error())
+		return
+	}
+	defer rows.Close()
+	type SharedFileInfo struct {
+		ID            int             `json:"id"`
+		Filename      string          `json:"filename"`
+		Size          int64           `json:"size"`
+		MimeType      string          `json:"mimeType"`
+		IsPublic      bool            `json:"isPublic"`
+		DownloadCount int             `json:"downloadCount"`
+		UploadedAt    time.Time       `json:"uploadedAt"`
+		URL           string          `json:"url"`
+		OwnerName     string          `json:"ownerName"`
+		SharedWith    json.RawMessage `json:"sharedWith"`
+		SharedGroups  json.RawMessage `json:"sharedWithGroups"`
+	}
+	var files []SharedFileInfo
+	for rows.Next() {
+		var f SharedFileInfo
+		if err := rows.Scan(&f.ID, &f.Filename, &f.Size, &f.MimeType, &f.IsPublic, &f.DownloadCount, &f.UploadedAt, &f.URL, &f.OwnerName, &f.SharedWith, &f.SharedGroups); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan shared file data: "+err.Error())
+			return
+		}
+		f.URL = sanitizeCloudinaryURL(f.URL)
+		files = append(files, f)
+	}
+	page := PageResponse{Items: []SharedFileInfo{}, Limit: params.Limit}
+	if params.hasMoreRows(len(files)) {
+		files = files[:params.Limit]
+		last := files[len(files)-1]
+		page.HasMore = true
+		page.NextCursor = params.nextCursor(fileCursorValue(params.SortBy, last.Filename, last.Size, last.UploadedAt, last.DownloadCount), int64(last.ID), nil)
+	}
+	if files != nil {
+		page.Items = files
+	}
+	writePage(w, params, page)
+}
+
+func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var ownerID, physicalFileID int
+	var filename string
+	err = tx.QueryRow(ctx, "SELECT owner_id, physical_file_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &physicalFileID, &filename)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if ownerID != user.ID && user.Role != "admin" {
+		writeError(w, http.StatusForbidden, "You do not have permission to delete this file")
+		return
+	}
+	_, err = tx.Exec(ctx, "DELETE FROM user_files WHERE id = $1", userFileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to delete file reference")
+		return
+	}
+	var refCount int
+	var publicID, mimeType string
+	err = tx.QueryRow(ctx, "UPDATE physical_files SET ref_count = ref_count - 1 WHERE id = $1 RETURNING ref_count, public_id, mime_type", physicalFileID).Scan(&refCount, &publicID, &mimeType)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update file reference count")
+		return
+	}
+	var released []uploadedBlob
+	if refCount == 0 {
+		released = append(renditionBlobs(ctx, tx, physicalFileID), uploadedBlob{PublicID: publicID, ResourceType: getResourceTypeFromMIME(mimeType)})
+		_, err = tx.Exec(ctx, "DELETE FROM physical_files WHERE id = $1", physicalFileID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to delete physical file record")
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	destroyUploadedBlobs(released)
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_DELETE", map[string]interface{}{"filename": filename})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "File deleted successfully"})
+}
+
+type duplicateFileEntry struct {
+	ID            int       `json:"id"`
+	Filename      string    `json:"filename"`
+	IsPublic      bool      `json:"isPublic"`
+	DownloadCount int       `json:"downloadCount"`
+	UploadedAt    time.Time `json:"uploadedAt"`
+	ShareCount    int       `json:"shareCount"`
+}
+
+func listDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	query := `SELECT pf.id, pf.size, pf.mime_type, jsonb_agg(jsonb_build_object('id', uf.id, 'filename', uf.filename, 'isPublic', uf.is_public, 'downloadCount', uf.download_count, 'uploadedAt', uf.uploaded_at, 'shareCount', (SELECT COUNT(*) FROM file_shares fs WHERE fs.user_file_id = uf.id AND ` + activeShareCondition + `)) ORDER BY uf.uploaded_at, uf.id) FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.owner_id = $1 GROUP BY pf.id HAVING COUNT(*) > 1 ORDER BY pf.size * (COUNT(*) - 1) DESC, pf.id`
+	rows, err := pool.Query(ctx, query, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query duplicates")
+		return
+	}
+	defer rows.Close()
+	type DuplicateGroup struct {
+		PhysicalFileID   int                  `json:"physicalFileId"`
+		Size             int64                `json:"size"`
+		MimeType         string               `json:"mimeType"`
+		Files            []duplicateFileEntry `json:"files"`
+		WastedReferences int                  `json:"wastedReferences"`
+		RedundantBytes   int64                `json:"redundantBytes"`
+	}
+	groups := []DuplicateGroup{}
+	var totalWasted int
+	var totalRedundant int64
+	for rows.Next() {
+		var g DuplicateGroup
+		var filesJSON []byte
+		if err := rows.Scan(&g.PhysicalFileID, &g.Size, &g.MimeType, &filesJSON); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan duplicate group")
+			return
+		}
+		if err := json.Unmarshal(filesJSON, &g.Files); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to decode duplicate group")
+			return
+		}
+		g.WastedReferences = len(g.Files) - 1
+		g.RedundantBytes = g.Size * int64(g.WastedReferences)
+		totalWasted += g.WastedReferences
+		totalRedundant += g.RedundantBytes
+		groups = append(groups, g)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups, "wastedReferences": totalWasted, "redundantBytes": totalRedundant})
+}
+
+func collapseDuplicatesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		KeepFileIDs []int `json:"keepFileIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if len(req.KeepFileIDs) == 0 {
+		writeError(w, http.StatusBadRequest, "keepFileIds must list at least one file")
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	type collapsed struct {
+		keptID     int
+		removedIDs []int
+		filenames  []string
+	}
+	var results []collapsed
+	seenPhysical := make(map[int]int)
+	for _, keepID := range req.KeepFileIDs {
+		var ownerID, physicalFileID int
+		err := tx.QueryRow(ctx, "SELECT owner_id, physical_file_id FROM user_files WHERE id = $1 FOR UPDATE", keepID).Scan(&ownerID, &physicalFileID)
+		if err != nil || ownerID != user.ID {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("File %d not found", keepID))
+			return
+		}
+		if other, ok := seenPhysical[physicalFileID]; ok {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Files %d and %d have the same content; keep only one", other, keepID))
+			return
+		}
+		seenPhysical[physicalFileID] = keepID
+		rows, err := tx.Query(ctx, "SELECT id, filename FROM user_files WHERE owner_id = $1 AND physical_file_id = $2 AND id <> $3 FOR UPDATE", user.ID, physicalFileID, keepID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to query duplicates")
+			return
+		}
+		c := collapsed{keptID: keepID}
+		for rows.Next() {
+			var id int
+			var filename string
+			if err := rows.Scan(&id, &filename); err != nil {
+				rows.Close()
+				writeError(w, http.StatusInternalServerError, "Failed to scan duplicate")
+				return
+			}
+			c.removedIDs = append(c.removedIDs, id)
+			c.filenames = append(c.filenames, filename)
+		}
+		rows.Close()
+		if len(c.removedIDs) == 0 {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO file_shares (user_file_id, recipient_id, permission, expires_at, status, shared_by) SELECT DISTINCT ON (fs.recipient_id) $1::int, fs.recipient_id, fs.permission, fs.expires_at, fs.status, fs.shared_by FROM file_shares fs WHERE fs.user_file_id = ANY($2) AND `+unexpiredShareCondition+` ORDER BY fs.recipient_id, fs.status = 'accepted' DESC, array_position(`+sharePermissionOrderSQL+`, fs.permission) DESC ON CONFLICT (user_file_id, recipient_id) DO UPDATE SET status = CASE WHEN file_shares.status = 'accepted' OR EXCLUDED.status = 'accepted' THEN 'accepted' ELSE 'pending' END, permission = CASE WHEN array_position(`+sharePermissionOrderSQL+`, EXCLUDED.permission) > array_position(`+sharePermissionOrderSQL+`, file_shares.permission) THEN EXCLUDED.permission ELSE file_shares.permission END, expires_at = CASE WHEN file_shares.expires_at IS NULL OR EXCLUDED.expires_at IS NULL THEN NULL ELSE GREATEST(file_shares.expires_at, EXCLUDED.expires_at) END`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to carry over shares")
+			return
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO group_file_shares (user_file_id, group_id, permission, shared_by) SELECT DISTINCT ON (group_id) $1::int, group_id, permission, shared_by FROM group_file_shares WHERE user_file_id = ANY($2) ORDER BY group_id, array_position(`+sharePermissionOrderSQL+`, permission) DESC ON CONFLICT (user_file_id, group_id) DO UPDATE SET permission = CASE WHEN array_position(`+sharePermissionOrderSQL+`, EXCLUDED.permission) > array_position(`+sharePermissionOrderSQL+`, group_file_shares.permission) THEN EXCLUDED.permission ELSE group_file_shares.permission END`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to carry over group shares")
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE public_links SET user_file_id = $1 WHERE user_file_id = ANY($2)`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to carry over public links")
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE access_requests SET user_file_id = $1 WHERE user_file_id = ANY($2) AND status <> 'pending'`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to carry over access requests")
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE access_requests SET user_file_id = $1 WHERE id IN (SELECT DISTINCT ON (requester_id) id FROM access_requests WHERE user_file_id = ANY($2) AND status = 'pending' AND requester_id NOT IN (SELECT requester_id FROM access_requests WHERE user_file_id = $1 AND status = 'pending') ORDER BY requester_id, created_at)`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to carry over access requests")
+			return
+		}
+		if _, err := tx.Exec(ctx, `UPDATE user_files SET is_public = is_public OR EXISTS (SELECT 1 FROM user_files WHERE id = ANY($2) AND is_public), download_count = download_count + (SELECT COALESCE(SUM(download_count), 0) FROM user_files WHERE id = ANY($2)) WHERE id = $1`, keepID, c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to update kept file")
+			return
+		}
+		if _, err := tx.Exec(ctx, "DELETE FROM user_files WHERE id = ANY($1)", c.removedIDs); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to delete duplicate references")
+			return
+		}
+		// The kept reference still points at the physical file, so the count
+		// never reaches zero here and the blob stays put.
+		if _, err := tx.Exec(ctx, "UPDATE physical_files SET ref_count = ref_count - $2 WHERE id = $1", physicalFileID, len(c.removedIDs)); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to update file reference count")
+			return
+		}
+		results = append(results, c)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	removedCount := 0
+	summary := []map[string]interface{}{}
+	for _, c := range results {
+		removedCount += len(c.removedIDs)
+		logAuditEvent(ctx, user.ID, c.keptID, "FILE_DUPLICATES_COLLAPSE", map[string]interface{}{"removedFileIds": c.removedIDs, "removedFilenames": c.filenames})
+		summary = append(summary, map[string]interface{}{"keptFileId": c.keptID, "removedFileIds": c.removedIDs})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": fmt.Sprintf("Removed %d duplicate reference(s)", removedCount), "removedCount": removedCount, "collapsed": summary})
+}
+
+func sameContentHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var ownerID, physicalFileID int
+	var permission *string
+	err = pool.QueryRow(ctx, `SELECT owner_id, physical_file_id, `+sharePermissionExpr("$1", "$2")+` FROM user_files WHERE id = $1`, userFileID, user.ID).Scan(&ownerID, &physicalFileID, &permission)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !canAccessFile(user, ownerID, permission, sharePermissionViewer) {
+		writeError(w, http.StatusForbidden, "You do not have permission to view this file")
+		return
+	}
+	query := `SELECT uf.id, uf.filename, uf.uploaded_at, u_owner.name, uf.owner_id = $1 FROM user_files uf JOIN users u_owner ON uf.owner_id = u_owner.id WHERE uf.physical_file_id = $2 AND uf.id <> $3 AND (uf.owner_id = $1 OR ` + sharePermissionExpr("uf.id", "$1") + ` IS NOT NULL) ORDER BY uf.uploaded_at, uf.id`
+	rows, err := pool.Query(ctx, query, user.ID, physicalFileID, userFileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query matching files")
+		return
+	}
+	defer rows.Close()
+	type MatchingFile struct {
+		ID         int       `json:"id"`
+		Filename   string    `json:"filename"`
+		UploadedAt time.Time `json:"uploadedAt"`
+		OwnerName  string    `json:"ownerName"`
+		IsOwn      bool      `json:"isOwn"`
+	}
+	files := []MatchingFile{}
+	for rows.Next() {
+		var f MatchingFile
+		if err := rows.Scan(&f.ID, &f.Filename, &f.UploadedAt, &f.OwnerName, &f.IsOwn); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan matching file")
+			return
+		}
+		files = append(files, f)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"fileId": userFileID, "files": files})
+}
+
+func unshareFileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	_, err = pool.Exec(ctx, "DELETE FROM file_shares WHERE user_file_id = $1 AND recipient_id = $2", userFileID, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to remove share")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_SELF", nil)
+	writeJSON(w, http.StatusOK, map[string]string{"message": "File removed from your view"})
+}
+
+const publicLinkTokenBytes = 32
+
+func newPublicLinkToken() (string, error) {
+	buf := make([]byte, publicLinkTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+func publicLinkURL(r *http.Request, token string) string {
+	return requestBaseURL(r) + "/files/public/" + token
+}
+
+type PublicLink struct {
+	ID                int        `json:"id"`
+	Label             *string    `json:"label,omitempty"`
+	URL               string     `json:"url"`
+	PasswordProtected bool       `json:"passwordProtected"`
+	DownloadCount     int        `json:"downloadCount"`
+	MaxDownloads      *int       `json:"maxDownloads,omitempty"`
+	ExpiresAt         *time.Time `json:"expiresAt,omitempty"`
+	CreatedAt         time.Time  `json:"createdAt"`
+}
+
+func publicLinkUsable(downloadCount int, maxDownloads *int, expiresAt *time.Time) bool {
+	if maxDownloads != nil && downloadCount >= *maxDownloads {
+		return false
+	}
+	return expiresAt == nil || time.Now().Before(*expiresAt)
+}
+
+const minPublicLinkPasswordLength = 6
+
+func hashPublicLinkPassword(password string) (*string, error) {
+	if password == "" {
+		return nil, nil
+	}
+	if len(password) < minPublicLinkPasswordLength {
+		return nil, fmt.Errorf("password must be at least %d characters", minPublicLinkPasswordLength)
+	}
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, err
+	}
+	hash := string(hashed)
+	return &hash, nil
+}
+
+func shareableFilename(ctx context.Context, w http.ResponseWriter, userFileID int, user *AuthenticatedUser) (string, bool) {
+	var ownerID int
+	var filename string
+	var permission *string
+	err := pool.QueryRow(ctx, "SELECT owner_id, filename, "+sharePermissionExpr("$1", "$2")+" FROM user_files WHERE id = $1", userFileID, user.ID).Scan(&ownerID, &filename, &permission)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "File not found")
+			return "", false
+		}
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return "", false
+	}
+	if !canAccessFile(user, ownerID, permission, sharePermissionCoOwner) {
+		writeError(w, http.StatusForbidden, "You are not allowed to change sharing for this file")
+		return "", false
+	}
+	return filename, true
+}
+
+func createPublicLink(ctx context.Context, r *http.Request, userFileID, createdBy int, label, passwordHash *string, maxDownloads *int, expiresAt *time.Time) (PublicLink, error) {
+	token, err := newPublicLinkToken()
+	if err != nil {
+		return PublicLink{}, fmt.Errorf("failed to generate link token: %w", err)
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return PublicLink{}, err
+	}
+	defer tx.Rollback(ctx)
+	link := PublicLink{Label: label, URL: publicLinkURL(r, token), PasswordProtected: passwordHash != nil, MaxDownloads: maxDownloads, ExpiresAt: expiresAt}
+	err = tx.QueryRow(ctx, `INSERT INTO public_links (user_file_id, token, label, created_by, password_hash, max_downloads, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, created_at`, userFileID, token, label, createdBy, passwordHash, maxDownloads, expiresAt).Scan(&link.ID, &link.CreatedAt)
+	if err != nil {
+		return PublicLink{}, fmt.Errorf("failed to create public link: %w", err)
+	}
+	if _, err := tx.Exec(ctx, "UPDATE user_files SET is_public = true WHERE id = $1", userFileID); err != nil {
+		return PublicLink{}, fmt.Errorf("failed to make file public: %w", err)
+	}
+	return link, tx.Commit(ctx)
+}
+
+// Reuses an active link so toggling a file public doesn't pile up tokens.
+func shareFileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	var token string
+	err = pool.QueryRow(ctx, "SELECT token FROM public_links WHERE user_file_id = $1 AND revoked_at IS NULL AND password_hash IS NULL AND max_downloads IS NULL AND expires_at IS NULL ORDER BY created_at DESC LIMIT 1", userFileID).Scan(&token)
+	if err == nil {
+		writeJSON(w, http.StatusOK, map[string]string{"message": "File is now public", "publicLink": publicLinkURL(r, token)})
+		return
+	}
+	if err != pgx.ErrNoRows {
+		writeError(w, http.StatusInternalServerError, "Failed to look up public links")
+		return
+	}
+	link, err := createPublicLink(ctx, r, userFileID, user.ID, nil, nil, nil, nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to make file public")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_PUBLIC", map[string]interface{}{"filename": filename, "linkId": link.ID})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "File is now public", "publicLink": link.URL})
+}
+
+func listPublicLinksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	if _, ok := shareableFilename(ctx, w, userFileID, user); !ok {
+		return
+	}
+	rows, err := pool.Query(ctx, `SELECT id, token, label, password_hash IS NOT NULL, download_count, max_downloads, expires_at, created_at FROM public_links WHERE user_file_id = $1 AND revoked_at IS NULL ORDER BY created_at`, userFileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query public links")
+		return
+	}
+	defer rows.Close()
+	links := []PublicLink{}
+	for rows.Next() {
+		var link PublicLink
+		var token string
+		if err := rows.Scan(&link.ID, &token, &link.Label, &link.PasswordProtected, &link.DownloadCount, &link.MaxDownloads, &link.ExpiresAt, &link.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan public link")
+			return
+		}
+		link.URL = publicLinkURL(r, token)
+		links = append(links, link)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"links": links})
+}
+
+func createPublicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var req struct {
+		Label        string     `json:"label"`
+		Password     string     `json:"password"`
+		MaxDownloads *int       `json:"maxDownloads"`
+		ExpiresAt    *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	var label *string
+	if trimmed := strings.TrimSpace(req.Label); trimmed != "" {
+		if len(trimmed) > 100 {
+			writeError(w, http.StatusBadRequest, "label must be at most 100 characters")
+			return
+		}
+		label = &trimmed
+	}
+	if req.MaxDownloads != nil && *req.MaxDownloads <= 0 {
+		writeError(w, http.StatusBadRequest, "maxDownloads must be positive")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+	passwordHash, err := hashPublicLinkPassword(req.Password)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	link, err := createPublicLink(ctx, r, userFileID, user.ID, label, passwordHash, req.MaxDownloads, req.ExpiresAt)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to create public link")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "PUBLIC_LINK_CREATE", map[string]interface{}{"filename": filename, "linkId": link.ID, "label": label, "passwordProtected": link.PasswordProtected, "maxDownloads": req.MaxDownloads, "expiresAt": req.ExpiresAt})
+	writeJSON(w, http.StatusCreated, link)
+}
+
+func revokePublicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	linkID, err := strconv.Atoi(vars["linkId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid link ID")
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var label *string
+	err = tx.QueryRow(ctx, `UPDATE public_links SET revoked_at = NOW() WHERE id = $1 AND user_file_id = $2 AND revoked_at IS NULL RETURNING label`, linkID, userFileID).Scan(&label)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Public link not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to revoke public link")
+		return
+	}
+	var stillPublic bool
+	err = tx.QueryRow(ctx, `UPDATE user_files SET is_public = EXISTS (SELECT 1 FROM public_links WHERE user_file_id = $1 AND revoked_at IS NULL) WHERE id = $1 RETURNING is_public`, userFileID).Scan(&stillPublic)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update file visibility")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "PUBLIC_LINK_REVOKE", map[string]interface{}{"filename": filename, "linkId": linkID, "label": label})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Public link revoked", "isPublic": stillPublic})
+}
+
+func setPublicLinkPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	linkID, err := strconv.Atoi(vars["linkId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid link ID")
+		return
+	}
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	passwordHash, err := hashPublicLinkPassword(req.Password)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	tag, err := pool.Exec(ctx, `UPDATE public_links SET password_hash = $3 WHERE id = $1 AND user_file_id = $2 AND revoked_at IS NULL`, linkID, userFileID, passwordHash)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update link password")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "Public link not found")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "PUBLIC_LINK_PASSWORD_SET", map[string]interface{}{"filename": filename, "linkId": linkID, "passwordProtected": passwordHash != nil})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Link password updated", "passwordProtected": passwordHash != nil})
+}
+
+// Per-purpose keys stop a value signed for one purpose being replayed as another.
+func signingKey(purpose string) []byte {
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func signValue(purpose, payload string) string {
+	mac := hmac.New(sha256.New, signingKey(purpose))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString([]byte(payload)) + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func verifySignedValue(purpose, signed string) (string, bool) {
+	encodedPayload, encodedSig, found := strings.Cut(signed, ".")
+	if !found {
+		return "", false
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encodedPayload)
+	if err != nil {
+		return "", false
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return "", false
+	}
+	mac := hmac.New(sha256.New, signingKey(purpose))
+	mac.Write(payload)
+	if !hmac.Equal(sig, mac.Sum(nil)) {
+		return "", false
+	}
+	return string(payload), true
+}
+
+const (
+	publicLinkUnlockTTL     = 15 * time.Minute
+	publicLinkAccessCookie  = "keyvia_link_access"
+	publicLinkAccessHeader  = "X-Link-Access"
+	publicLinkUnlockPurpose = "public-link-unlock"
+)
+
+// The per-link ceiling stops rotating addresses from buying unlimited guesses.
+const (
+	unlockPerClientPerMinute = 5
+	unlockPerLinkPerMinute   = 30
+)
+
+var unlockLimiterCache = cache.New(30*time.Minute, time.Hour)
+
+func unlockLimiter(key string, perMinute int) *rate.Limiter {
+	if limiter, found := unlockLimiterCache.Get(key); found {
+		return limiter.(*rate.Limiter)
+	}
+	limiter := rate.NewLimiter(rate.Limit(float64(perMinute)/60), perMinute)
+	unlockLimiterCache.Set(key, limiter, cache.DefaultExpiration)
+	return limiter
+}
+
+const (
+	accessRequestsPerHour       = 10
+	accessRequestBurst          = 3
+	accessRequestMessageMax     = 500
+	accessRequestDeniedCooldown = 24 * time.Hour
+)
+
+var accessRequestLimiterCache = cache.New(2*time.Hour, 4*time.Hour)
+
+func accessRequestLimiter(userID int) *rate.Limiter {
+	key := strconv.Itoa(userID)
+	if limiter, found := accessRequestLimiterCache.Get(key); found {
+		return limiter.(*rate.Limiter)
+	}
+	limiter := rate.NewLimiter(rate.Every(time.Hour/accessRequestsPerHour), accessRequestBurst)
+	accessRequestLimiterCache.Set(key, limiter, cache.DefaultExpiration)
+	return limiter
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, network := range appConfig.TrustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteHost(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func requestScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if isTrustedProxy(remoteHost(r)) {
+		if proto := strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme
+}
+
+func requestBaseURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host
+}
+
+// X-Forwarded-For is only honoured when the connection comes from a trusted proxy.
+func clientIP(r *http.Request) string {
+	remote := remoteHost(r)
+	forwarded := r.Header.Get("X-Forwarded-For")
+	if forwarded == "" || !isTrustedProxy(remote) {
+		return remote
+	}
+	hops := strings.Split(forwarded, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if !isTrustedProxy(hop) {
+			return hop
+		}
+	}
+	return strings.TrimSpace(hops[0])
+}
+
+// Changing or clearing a link password revokes unlock tokens issued for the old one.
+func passwordFingerprint(passwordHash string) string {
+	sum := sha256.Sum256([]byte(passwordHash))
+	return hex.EncodeToString(sum[:8])
+}
+
+func issueLinkUnlockToken(linkID int, passwordHash string, expiresAt time.Time) string {
+	return signValue(publicLinkUnlockPurpose, fmt.Sprintf("%d:%d:%s", linkID, expiresAt.Unix(), passwordFingerprint(passwordHash)))
+}
+
+func linkUnlockTokenValid(unlockToken string, linkID int, passwordHash string) bool {
+	payload, ok := verifySignedValue(publicLinkUnlockPurpose, unlockToken)
+	if !ok {
+		return false
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 || parts[0] != strconv.Itoa(linkID) || parts[2] != passwordFingerprint(passwordHash) {
+		return false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	return err == nil && time.Now().Unix() < expires
+}
+
+func unlockPublicLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := mux.Vars(r)["token"]
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	var linkID, userFileID, ownerID, downloadCount int
+	var passwordHash *string
+	var maxDownloads *int
+	var expiresAt *time.Time
+	err := pool.QueryRow(ctx, `SELECT pl.id, uf.id, uf.owner_id, pl.password_hash, pl.download_count, pl.max_downloads, pl.expires_at FROM public_links pl JOIN user_files uf ON pl.user_file_id = uf.id WHERE pl.token = $1 AND pl.revoked_at IS NULL`, token).Scan(&linkID, &userFileID, &ownerID, &passwordHash, &downloadCount, &maxDownloads, &expiresAt)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !publicLinkUsable(downloadCount, maxDownloads, expiresAt) {
+		writeError(w, http.StatusGone, "This link has expired or reached its download limit")
+		return
+	}
+	if passwordHash == nil {
+		writeError(w, http.StatusBadRequest, "This link is not password protected")
+		return
+	}
+	ip := clientIP(r)
+	if !unlockLimiter(fmt.Sprintf("%d|%s", linkID, ip), unlockPerClientPerMinute).Allow() || !unlockLimiter(strconv.Itoa(linkID), unlockPerLinkPerMinute).Allow() {
+		logAuditEvent(ctx, ownerID, userFileID, "PUBLIC_LINK_UNLOCK_THROTTLED", map[string]interface{}{"linkId": linkID, "ip": ip})
+		writeError(w, http.StatusTooManyRequests, "Too many unlock attempts, try again later")
+		return
+	}
+	if bcrypt.CompareHashAndPassword([]byte(*passwordHash), []byte(req.Password)) != nil {
+		logAuditEvent(ctx, ownerID, userFileID, "PUBLIC_LINK_UNLOCK_FAILED", map[string]interface{}{"linkId": linkID, "ip": ip})
+		writeError(w, http.StatusUnauthorized, "Incorrect password")
+		return
+	}
+	unlockExpiresAt := time.Now().Add(publicLinkUnlockTTL)
+	accessToken := issueLinkUnlockToken(linkID, *passwordHash, unlockExpiresAt)
+	http.SetCookie(w, &http.Cookie{
+		Name:     publicLinkAccessCookie,
+		Value:    accessToken,
+		Path:     "/files/public/" + token,
+		Expires:  unlockExpiresAt,
+		HttpOnly: true,
+		Secure:   requestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	logAuditEvent(ctx, ownerID, userFileID, "PUBLIC_LINK_UNLOCK", map[string]interface{}{"linkId": linkID, "ip": ip})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"accessToken": accessToken, "expiresAt": unlockExpiresAt, "downloadUrl": publicLinkURL(r, token)})
+}
+
+func publicDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	token := mux.Vars(r)["token"]
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var linkID, userFileID, ownerID, downloadCount int
+	var storageURL, filename, scanStatus string
+	var passwordHash, label *string
+	var maxDownloads *int
+	var expiresAt *time.Time
+	query := `SELECT pl.id, uf.id, uf.owner_id, pf.storage_url, uf.filename, pf.scan_status, pl.password_hash, pl.label, pl.download_count, pl.max_downloads, pl.expires_at FROM public_links pl JOIN user_files uf ON pl.user_file_id = uf.id JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE pl.token = $1 AND pl.revoked_at IS NULL`
+	err = tx.QueryRow(ctx, query, token).Scan(&linkID, &userFileID, &ownerID, &storageURL, &filename, &scanStatus, &passwordHash, &label, &downloadCount, &maxDownloads, &expiresAt)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !publicLinkUsable(downloadCount, maxDownloads, expiresAt) {
+		writeError(w, http.StatusGone, "This link has expired or reached its download limit")
+		return
+	}
+	if passwordHash != nil {
+		access := r.Header.Get(publicLinkAccessHeader)
+		if cookie, err := r.Cookie(publicLinkAccessCookie); err == nil {
+			access = cookie.Value
+		}
+		if !linkUnlockTokenValid(access, linkID, *passwordHash) {
+			writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "This link is password protected", "unlockUrl": publicLinkURL(r, token) + "/unlock"})
+			return
+		}
+	}
+	if status, message, blocked := scanBlocksDownload(scanStatus); blocked {
+		writeError(w, status, message)
+		return
+	}
+	// Consume one download from the link's allowance. The conditions are
+	// re-checked in the UPDATE so concurrent requests can't overdraw it.
+	err = tx.QueryRow(ctx, `UPDATE public_links SET download_count = download_count + 1 WHERE id = $1 AND (max_downloads IS NULL OR download_count < max_downloads) AND (expires_at IS NULL OR expires_at > NOW()) RETURNING download_count`, linkID).Scan(&downloadCount)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusGone, "This link has expired or reached its download limit")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	_, err = tx.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", userFileID)
+	if err != nil {
+		log.Printf("Failed to increment download count for file %d: %v", userFileID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	logAuditEvent(ctx, 0, userFileID, "FILE_DOWNLOAD_PUBLIC", map[string]interface{}{"ip": r.RemoteAddr, "filename": filename, "linkId": linkID})
+	if maxDownloads != nil && downloadCount >= *maxDownloads {
+		logAuditEvent(ctx, ownerID, userFileID, "PUBLIC_LINK_EXHAUSTED", map[string]interface{}{"filename": filename, "linkId": linkID, "label": label, "maxDownloads": *maxDownloads})
+	}
+	http.Redirect(w, r, storageURL, http.StatusFound)
+}
+
+func legacyPublicDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	if !appConfig.LegacyPublicIDLinks {
+		writeError(w, http.StatusGone, "This link format has been retired. Ask the owner for a new public link.")
+		return
+	}
+	ctx := r.Context()
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var isPublic bool
+	var storageURL, filename, scanStatus string
+	// A file whose only links carry a password, limit or expiry must not be
+	// reachable through its bare ID.
+	query := `SELECT uf.is_public AND (EXISTS (SELECT 1 FROM public_links pl WHERE pl.user_file_id = uf.id AND pl.revoked_at IS NULL AND pl.password_hash IS NULL AND pl.max_downloads IS NULL AND pl.expires_at IS NULL) OR NOT EXISTS (SELECT 1 FROM public_links pl WHERE pl.user_file_id = uf.id AND pl.revoked_at IS NULL)), pf.storage_url, uf.filename, pf.scan_status FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = $1`
+	err = tx.QueryRow(ctx, query, userFileID).Scan(&isPublic, &storageURL, &filename, &scanStatus)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !isPublic {
+		writeError(w, http.StatusForbidden, "This file is not public")
+		return
+	}
+	if status, message, blocked := scanBlocksDownload(scanStatus); blocked {
+		writeError(w, status, message)
+		return
+	}
+	_, err = tx.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", userFileID)
+	if err != nil {
+		log.Printf("Failed to increment download count for file %d: %v", userFileID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	logAuditEvent(ctx, 0, userFileID, "FILE_DOWNLOAD_PUBLIC", map[string]interface{}{"ip": r.RemoteAddr, "filename": filename, "legacyLink": true})
+	http.Redirect(w, r, storageURL, http.StatusFound)
+}
+
+func authenticatedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	user := r.Context().Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	serveFileDownload(w, r, user, userFileID, "FILE_DOWNLOAD_AUTH")
+}
+
+func serveFileDownload(w http.ResponseWriter, r *http.Request, user *AuthenticatedUser, userFileID int, auditAction string) {
+	ctx := r.Context()
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var ownerID int
+	var permission *string
+	var storageURL, filename, scanStatus string
+	query := `SELECT uf.owner_id, pf.storage_url, uf.filename, pf.scan_status, ` + sharePermissionExpr("$1", "$2") + ` FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = $1`
+	err = tx.QueryRow(ctx, query, userFileID, user.ID).Scan(&ownerID, &storageURL, &filename, &scanStatus, &permission)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "File not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Database error on scan")
+		return
+	}
+	if !canAccessFile(user, ownerID, permission, sharePermissionDownloader) {
+		writeError(w, http.StatusForbidden, "You do not have permission to download this file")
+		return
+	}
+	if status, message, blocked := scanBlocksDownload(scanStatus); blocked {
+		writeError(w, status, message)
+		return
+	}
+	_, err = tx.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", userFileID)
+	if err != nil {
+		log.Printf("Failed to increment download count for file %d: %v", userFileID, err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error on commit")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, auditAction, map[string]interface{}{"filename": filename})
+	http.Redirect(w, r, storageURL, http.StatusFound)
+}
+
+const (
+	signedDownloadTTL     = time.Minute
+	signedDownloadPurpose = "signed-download"
+)
+
+func createSignedDownloadURLHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var ownerID int
+	var permission *string
+	err = pool.QueryRow(ctx, "SELECT owner_id, "+sharePermissionExpr("$1", "$2")+" FROM user_files WHERE id = $1", userFileID, user.ID).Scan(&ownerID, &permission)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !canAccessFile(user, ownerID, permission, sharePermissionDownloader) {
+		writeError(w, http.StatusForbidden, "You do not have permission to download this file")
+		return
+	}
+	expiresAt := time.Now().Add(signedDownloadTTL)
+	signature := signValue(signedDownloadPurpose, fmt.Sprintf("%d:%d:%d", userFileID, user.ID, expiresAt.Unix()))
+	url := requestBaseURL(r) + "/files/download/" + signature
+	writeJSON(w, http.StatusOK, map[string]interface{}{"url": url, "expiresAt": expiresAt})
+}
+
+func signedDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	payload, ok := verifySignedValue(signedDownloadPurpose, mux.Vars(r)["signature"])
+	if !ok {
+		writeError(w, http.StatusForbidden, "Invalid download signature")
+		return
+	}
+	parts := strings.Split(payload, ":")
+	if len(parts) != 3 {
+		writeError(w, http.StatusForbidden, "Invalid download signature")
+		return
+	}
+	userFileID, err1 := strconv.Atoi(parts[0])
+	userID, err2 := strconv.Atoi(parts[1])
+	expires, err3 := strconv.ParseInt(parts[2], 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		writeError(w, http.StatusForbidden, "Invalid download signature")
+		return
+	}
+	if time.Now().Unix() >= expires {
+		writeError(w, http.StatusGone, "This download link has expired")
+		return
+	}
+	user := &AuthenticatedUser{ID: userID}
+	if err := pool.QueryRow(ctx, "SELECT role FROM users WHERE id = $1", userID).Scan(&user.Role); err != nil {
+		writeError(w, http.StatusForbidden, "Invalid download signature")
+		return
+	}
+	serveFileDownload(w, r, user, userFileID, "FILE_DOWNLOAD_SIGNED")
+}
+
+func numberedFilename(filename string, n int) string {
+	ext := filepath.Ext(filename)
+	suffix := fmt.Sprintf(" (%d)%s", n, ext)
+	if utf8.RuneCountInString(suffix) >= maxFilenameLength {
+		ext = ""
+		suffix = fmt.Sprintf(" (%d)", n)
+	}
+	base := []rune(strings.TrimSuffix(filename, ext))
+	if keep := maxFilenameLength - utf8.RuneCountInString(suffix); len(base) > keep {
+		base = base[:keep]
+	}
+	return string(base) + suffix
+}
+
+const maxArchiveFiles = 200
+
+func archiveDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		FileIDs []int `json:"fileIds"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	seen := make(map[int]bool)
+	var fileIDs []int
+	for _, id := range req.FileIDs {
+		if !seen[id] {
+			seen[id] = true
+			fileIDs = append(fileIDs, id)
+		}
+	}
+	if len(fileIDs) == 0 {
+		writeError(w, http.StatusBadRequest, "No files provided in 'fileIds' field")
+		return
+	}
+	if len(fileIDs) > maxArchiveFiles {
+		writeError(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("An archive can contain at most %d files", maxArchiveFiles))
+		return
+	}
+	type ArchiveEntry struct {
+		ID         int
+		OwnerID    int
+		StorageURL string
+		Filename   string
+		ScanStatus string
+		Permission *string
+	}
+	query := `SELECT uf.id, uf.owner_id, pf.storage_url, uf.filename, pf.scan_status, ` + sharePermissionExpr("uf.id", "$2") + ` FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = ANY($1) ORDER BY uf.id`
+	rows, err := pool.Query(ctx, query, fileIDs, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query files: "+err.Error())
+		return
+	}
+	var entries []ArchiveEntry
+	for rows.Next() {
+		var e ArchiveEntry
+		if err := rows.Scan(&e.ID, &e.OwnerID, &e.StorageURL, &e.Filename, &e.ScanStatus, &e.Permission); err != nil {
+			rows.Close()
+			writeError(w, http.StatusInternalServerError, "Failed to scan file data: "+err.Error())
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if len(entries) != len(fileIDs) {
+		writeError(w, http.StatusNotFound, "One or more files not found")
+		return
+	}
+	for _, e := range entries {
+		if !canAccessFile(user, e.OwnerID, e.Permission, sharePermissionDownloader) {
+			writeError(w, http.StatusForbidden, fmt.Sprintf("You do not have permission to download file %d", e.ID))
+			return
+		}
+		if status, message, blocked := scanBlocksDownload(e.ScanStatus); blocked {
+			writeError(w, status, fmt.Sprintf("%s (%s)", message, e.Filename))
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="keyvia-%s.zip"`, time.Now().Format("20060102-150405")))
+	w.WriteHeader(http.StatusOK)
+	zw := zip.NewWriter(w)
+	usedNames := make(map[string]bool)
+	var includedIDs []int
+	for _, e := range entries {
+		base := sanitizeFilename(e.Filename)
+		name := base
+		for n := 1; usedNames[strings.ToLower(name)]; n++ {
+			name = numberedFilename(base, n)
+		}
+		usedNames[strings.ToLower(name)] = true
+		if err := writeArchiveEntry(ctx, zw, name, e.StorageURL); err != nil {
+			log.Printf("Archive aborted for user %d at file %d: %v", user.ID, e.ID, err)
+			panic(http.ErrAbortHandler)
+		}
+		includedIDs = append(includedIDs, e.ID)
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finalize archive for user %d: %v", user.ID, err)
+		panic(http.ErrAbortHandler)
+	}
+	if _, err := pool.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = ANY($1)", includedIDs); err != nil {
+		log.Printf("Failed to increment download counts for archive: %v", err)
+	}
+	for _, e := range entries {
+		logAuditEvent(ctx, user.ID, e.ID, "FILE_DOWNLOAD_ARCHIVE", map[string]interface{}{"filename": e.Filename, "archiveSize": len(entries)})
+	}
+}
+
+func writeArchiveEntry(ctx context.Context, zw *zip.Writer, name, storageURL string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, storageURL, nil)
+	if err != nil {
+		return fmt.Errorf("could not build storage request: %w", err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("could not fetch file from storage: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage returned status %d", resp.StatusCode)
+	}
+	entry, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: time.Now()})
+	if err != nil {
+		return fmt.Errorf("could not create archive entry: %w", err)
+	}
+	if _, err := io.Copy(entry, resp.Body); err != nil {
+		return fmt.Errorf("could not stream file into archive: %w", err)
+	}
+	return nil
+}
+
+const (
+	sharePermissionViewer     = "viewer"     // metadata and previews only
+	sharePermissionDownloader = "downloader" // plus downloading the content
+	sharePermissionEditor     = "editor"     // plus renaming and metadata edits
+	sharePermissionCoOwner    = "co-owner"   // plus re-sharing with others
+)
+
+var sharePermissionRank = map[string]int{
+	sharePermissionViewer:     1,
+	sharePermissionDownloader: 2,
+	sharePermissionEditor:     3,
+	sharePermissionCoOwner:    4,
+}
+
+const sharePermissionOrderSQL = "ARRAY['viewer', 'downloader', 'editor', 'co-owner']::text[]"
+
+const unexpiredShareCondition = "(fs.expires_at IS NULL OR fs.expires_at > NOW())"
+
+// Every access check must apply this, so pending invitations grant nothing.
+const activeShareCondition = "(fs.status = 'accepted' AND " + unexpiredShareCondition + ")"
+
+const (
+	shareStatusPending  = "pending"
+	shareStatusAccepted = "accepted"
+)
+
+const shareInvitationDeclinedCooldown = 24 * time.Hour
+
+const (
+	shareInvitationAcceptAll   = "accept_all"
+	shareInvitationTrustedOnly = "trusted_only"
+	shareInvitationAlwaysAsk   = "always_ask"
+)
+
+func sharePermissionExpr(fileRef, userRef string) string {
+	return fmt.Sprintf(`(SELECT p.permission FROM (SELECT fs.permission FROM file_shares fs WHERE fs.user_file_id = %[1]s AND fs.recipient_id = %[2]s AND %[3]s UNION ALL SELECT gs.permission FROM group_file_shares gs JOIN group_members gm ON gm.group_id = gs.group_id WHERE gs.user_file_id = %[1]s AND gm.user_id = %[2]s AND gm.status = 'accepted') p ORDER BY array_position(%[4]s, p.permission) DESC LIMIT 1)`, fileRef, userRef, activeShareCondition, sharePermissionOrderSQL)
+}
+
+// Admins keep read access to every file but can't edit or re-share files they don't own.
+func canAccessFile(user *AuthenticatedUser, ownerID int, permission *string, required string) bool {
+	if ownerID == user.ID {
+		return true
+	}
+	if user.Role == "admin" && sharePermissionRank[required] <= sharePermissionRank[sharePermissionDownloader] {
+		return true
+	}
+	return permission != nil && sharePermissionRank[*permission] >= sharePermissionRank[required]
+}
+
+func shareWithUserHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var req struct {
+		ShareWithUsername string     `json:"shareWithUsername"`
+		Permission        string     `json:"permission"`
+		ExpiresAt         *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = sharePermissionDownloader
+	}
+	if _, ok := sharePermissionRank[req.Permission]; !ok {
+		writeError(w, http.StatusBadRequest, "permission must be one of viewer, downloader, editor or co-owner")
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+	var recipientID int
+	err = pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", req.ShareWithUsername).Scan(&recipientID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User to share with not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if user.ID == recipientID {
+		writeError(w, http.StatusBadRequest, "You cannot share a file with yourself")
+		return
+	}
+	var ownerID int
+	var filename string
+	var permission *string
+	err = pool.QueryRow(ctx, "SELECT owner_id, filename, "+sharePermissionExpr("$1", "$2")+" FROM user_files WHERE id = $1", userFileID, user.ID).Scan(&ownerID, &filename, &permission)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if !canAccessFile(user, ownerID, permission, sharePermissionCoOwner) {
+		writeError(w, http.StatusForbidden, "You are not allowed to share this file")
+		return
+	}
+	if req.Permission == sharePermissionCoOwner && ownerID != user.ID {
+		writeError(w, http.StatusForbidden, "Only the file owner can grant co-owner access")
+		return
+	}
+	if recipientID == ownerID {
+		writeError(w, http.StatusBadRequest, "The file already belongs to this user")
+		return
+	}
+	status, err := shareStatusFor(ctx, recipientID, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	if status == shareStatusPending {
+		declined, err := recentlyDeclinedSender(ctx, recipientID, user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Database error")
+			return
+		}
+		if declined {
+			writeError(w, http.StatusTooManyRequests, "This user declined an invitation from you recently; try again later")
+			return
+		}
+	}
+	// An expired share the sweeper hasn't removed yet is replaced in place
+	// rather than reported as a conflict.
+	var shareID int
+	var senderUsername string
+	err = pool.QueryRow(ctx, `INSERT INTO file_shares (user_file_id, recipient_id, permission, expires_at, status, shared_by) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (user_file_id, recipient_id) DO UPDATE SET permission = EXCLUDED.permission, expires_at = EXCLUDED.expires_at, status = EXCLUDED.status, shared_by = EXCLUDED.shared_by, shared_at = NOW() WHERE file_shares.expires_at IS NOT NULL AND file_shares.expires_at <= NOW() RETURNING id, (SELECT username FROM users WHERE id = $6)`, userFileID, recipientID, req.Permission, req.ExpiresAt, status, user.ID).Scan(&shareID, &senderUsername)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeJSON(w, http.StatusConflict, map[string]string{"message": "File already shared with this user"})
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to share file")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_USER", map[string]interface{}{"filename": filename, "recipientUsername": req.ShareWithUsername, "permission": req.Permission, "expiresAt": req.ExpiresAt, "status": status})
+	if status == shareStatusPending {
+		logAuditEvent(ctx, recipientID, userFileID, "SHARE_INVITATION_RECEIVED", map[string]interface{}{"filename": filename, "invitationId": shareID, "senderId": user.ID, "senderUsername": senderUsername, "permission": req.Permission})
+		writeJSON(w, http.StatusCreated, map[string]interface{}{"message": fmt.Sprintf("Invitation sent to %s", req.ShareWithUsername), "permission": req.Permission, "expiresAt": req.ExpiresAt, "status": status})
+		return
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": fmt.Sprintf("File successfully shared with %s", req.ShareWithUsername), "permission": req.Permission, "expiresAt": req.ExpiresAt, "status": status})
+}
+
+func shareStatusFor(ctx context.Context, recipientID, senderID int) (string, error) {
+	var mode string
+	var trusted bool
+	err := pool.QueryRow(ctx, `SELECT share_invitation_mode, EXISTS (SELECT 1 FROM trusted_share_senders WHERE user_id = $1 AND sender_id = $2) FROM users WHERE id = $1`, recipientID, senderID).Scan(&mode, &trusted)
+	if err != nil {
+		return "", err
+	}
+	if mode == shareInvitationAcceptAll || (mode == shareInvitationTrustedOnly && trusted) {
+		return shareStatusAccepted, nil
+	}
+	return shareStatusPending, nil
+}
+
+const recordDeclinedSenderSQL = `INSERT INTO declined_share_senders (user_id, sender_id) SELECT $2, shared_by FROM declined WHERE shared_by IS NOT NULL ON CONFLICT (user_id, sender_id) DO UPDATE SET declined_at = NOW()`
+
+func recentlyDeclinedSender(ctx context.Context, recipientID, senderID int) (bool, error) {
+	var declined bool
+	err := pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM declined_share_senders WHERE user_id = $1 AND sender_id = $2 AND declined_at > NOW() - $3::interval)`, recipientID, senderID, fmt.Sprintf("%d seconds", int(shareInvitationDeclinedCooldown.Seconds()))).Scan(&declined)
+	return declined, err
+}
+
+func listShareInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	rows, err := pool.Query(ctx, `SELECT fs.id, uf.id, uf.filename, pf.size, pf.mime_type, fs.permission, fs.shared_at, fs.expires_at, u_owner.name, fs.shared_by, COALESCE(u_sender.username, '') FROM file_shares fs JOIN user_files uf ON fs.user_file_id = uf.id JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id LEFT JOIN users u_sender ON fs.shared_by = u_sender.id WHERE fs.recipient_id = $1 AND fs.status = 'pending' AND `+unexpiredShareCondition+` ORDER BY fs.shared_at DESC, fs.id DESC`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query invitations")
+		return
+	}
+	defer rows.Close()
+	type ShareInvitation struct {
+		ID             int        `json:"id"`
+		FileID         int        `json:"fileId"`
+		Filename       string     `json:"filename"`
+		Size           int64      `json:"size"`
+		MimeType       string     `json:"mimeType"`
+		Permission     string     `json:"permission"`
+		SharedAt       time.Time  `json:"sharedAt"`
+		ExpiresAt      *time.Time `json:"expiresAt"`
+		OwnerName      string     `json:"ownerName"`
+		SenderID       *int       `json:"senderId"`
+		SenderUsername string     `json:"senderUsername"`
+	}
+	invitations := []ShareInvitation{}
+	for rows.Next() {
+		var inv ShareInvitation
+		if err := rows.Scan(&inv.ID, &inv.FileID, &inv.Filename, &inv.Size, &inv.MimeType, &inv.Permission, &inv.SharedAt, &inv.ExpiresAt, &inv.OwnerName, &inv.SenderID, &inv.SenderUsername); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan invitation")
+			return
+		}
+		invitations = append(invitations, inv)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"invitations": invitations})
+}
+
+func respondShareInvitationHandler(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := ctx.Value(userContextKey).(*AuthenticatedUser)
+		invitationID, err := strconv.Atoi(mux.Vars(r)["invitationId"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid invitation ID")
+			return
+		}
+		query := `UPDATE file_shares fs SET status = 'accepted', shared_at = NOW() FROM user_files uf WHERE uf.id = fs.user_file_id AND fs.id = $1 AND fs.recipient_id = $2 AND fs.status = 'pending' AND ` + unexpiredShareCondition + ` RETURNING uf.id, uf.filename, fs.shared_by, fs.permission, (SELECT username FROM users WHERE id = $2)`
+		if !accept {
+			query = `WITH declined AS (DELETE FROM file_shares fs USING user_files uf WHERE uf.id = fs.user_file_id AND fs.id = $1 AND fs.recipient_id = $2 AND fs.status = 'pending' AND ` + unexpiredShareCondition + ` RETURNING uf.id, uf.filename, fs.shared_by, fs.permission), recorded AS (` + recordDeclinedSenderSQL + `) SELECT id, filename, shared_by, permission, (SELECT username FROM users WHERE id = $2) FROM declined`
+		}
+		var fileID int
+		var filename, permission, recipientUsername string
+		var senderID *int
+		if err := pool.QueryRow(ctx, query, invitationID, user.ID).Scan(&fileID, &filename, &senderID, &permission, &recipientUsername); err != nil {
+			if err == pgx.ErrNoRows {
+				writeError(w, http.StatusNotFound, "Invitation not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "Failed to update invitation")
+			return
+		}
+		action, senderAction, message := "SHARE_INVITATION_DECLINE", "SHARE_INVITATION_DECLINED", "Invitation declined"
+		if accept {
+			action, senderAction, message = "SHARE_INVITATION_ACCEPT", "SHARE_INVITATION_ACCEPTED", "Invitation accepted"
+			if senderID != nil {
+				if _, err := pool.Exec(ctx, `INSERT INTO trusted_share_senders (user_id, sender_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, user.ID, *senderID); err != nil {
+					log.Printf("Failed to record trusted sender %d for user %d: %v", *senderID, user.ID, err)
+				}
+			}
+		}
+		logAuditEvent(ctx, user.ID, fileID, action, map[string]interface{}{"filename": filename, "invitationId": invitationID, "senderId": senderID, "permission": permission})
+		if senderID != nil {
+			logAuditEvent(ctx, *senderID, fileID, senderAction, map[string]interface{}{"filename": filename, "invitationId": invitationID, "recipientId": user.ID, "recipientUsername": recipientUsername})
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"message": message, "fileId": fileID})
+	}
+}
+
+func getSharePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var mode string
+	if err := pool.QueryRow(ctx, `SELECT share_invitation_mode FROM users WHERE id = $1`, user.ID).Scan(&mode); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to load share preferences")
+		return
+	}
+	rows, err := pool.Query(ctx, `SELECT u.id, u.username, u.name, ts.trusted_at FROM trusted_share_senders ts JOIN users u ON ts.sender_id = u.id WHERE ts.user_id = $1 ORDER BY LOWER(u.username)`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query trusted senders")
+		return
+	}
+	defer rows.Close()
+	type TrustedSender struct {
+		ID        int       `json:"id"`
+		Username  string    `json:"username"`
+		Name      string    `json:"name"`
+		TrustedAt time.Time `json:"trustedAt"`
+	}
+	senders := []TrustedSender{}
+	for rows.Next() {
+		var ts TrustedSender
+		if err := rows.Scan(&ts.ID, &ts.Username, &ts.Name, &ts.TrustedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan trusted sender")
+			return
+		}
+		senders = append(senders, ts)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"invitationMode": mode, "trustedSenders": senders})
+}
+
+func updateSharePreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		InvitationMode string `json:"invitationMode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	switch req.InvitationMode {
+	case shareInvitationAcceptAll, shareInvitationTrustedOnly, shareInvitationAlwaysAsk:
+	default:
+		writeError(w, http.StatusBadRequest, "invitationMode must be one of accept_all, trusted_only or always_ask")
+		return
+	}
+	if _, err := pool.Exec(ctx, `UPDATE users SET share_invitation_mode = $2 WHERE id = $1`, user.ID, req.InvitationMode); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update share preferences")
+		return
+	}
+	logAuditEvent(ctx, user.ID, user.ID, "SHARE_PREFERENCES_UPDATE", map[string]interface{}{"invitationMode": req.InvitationMode})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Share preferences updated", "invitationMode": req.InvitationMode})
+}
+
+func removeTrustedSenderHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	senderID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	tag, err := pool.Exec(ctx, `DELETE FROM trusted_share_senders WHERE user_id = $1 AND sender_id = $2`, user.ID, senderID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to remove trusted sender")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "User is not a trusted sender")
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Trusted sender removed"})
+}
+
+func createAccessRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var req struct {
+		Message    string `json:"message"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Message = strings.TrimSpace(req.Message)
+	if len(req.Message) > accessRequestMessageMax {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("message must be at most %d characters", accessRequestMessageMax))
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = sharePermissionDownloader
+	}
+	if _, ok := sharePermissionRank[req.Permission]; !ok {
+		writeError(w, http.StatusBadRequest, "permission must be one of viewer, downloader, editor or co-owner")
+		return
+	}
+	var ownerID int
+	var filename string
+	var permission *string
+	var recentlyDenied bool
+	err = pool.QueryRow(ctx, `SELECT owner_id, filename, `+sharePermissionExpr("$1", "$2")+`, EXISTS (SELECT 1 FROM access_requests ar WHERE ar.user_file_id = $1 AND ar.requester_id = $2 AND ar.status = 'denied' AND ar.resolved_at > NOW() - $3::interval) FROM user_files WHERE id = $1`, userFileID, user.ID, fmt.Sprintf("%d seconds", int(accessRequestDeniedCooldown.Seconds()))).Scan(&ownerID, &filename, &permission, &recentlyDenied)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return
+	}
+	if ownerID == user.ID || permission != nil {
+		writeError(w, http.StatusConflict, "You already have access to this file")
+		return
+	}
+	if recentlyDenied {
+		writeError(w, http.StatusTooManyRequests, "Your previous request for this file was denied recently; try again later")
+		return
+	}
+	if !accessRequestLimiter(user.ID).Allow() {
+		writeError(w, http.StatusTooManyRequests, "Too many access requests; try again later")
+		return
+	}
+	var requestID int
+	err = pool.QueryRow(ctx, `INSERT INTO access_requests (user_file_id, requester_id, message, permission) VALUES ($1, $2, $3, $4) RETURNING id`, userFileID, user.ID, req.Message, req.Permission).Scan(&requestID)
+	if err != nil {
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "You already have a pending request for this file")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to create access request")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "ACCESS_REQUEST_CREATE", map[string]interface{}{"requestId": requestID, "permission": req.Permission})
+	logAuditEvent(ctx, ownerID, userFileID, "ACCESS_REQUEST_RECEIVED", map[string]interface{}{"requestId": requestID, "filename": filename, "requesterId": user.ID, "permission": req.Permission})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": "Access request sent to the file owner", "id": requestID, "status": "pending"})
+}
+
+func listAccessRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	rows, err := pool.Query(ctx, `SELECT ar.id, uf.id, uf.filename, u.id, u.username, u.name, ar.message, ar.permission, ar.created_at FROM access_requests ar JOIN user_files uf ON ar.user_file_id = uf.id JOIN users u ON ar.requester_id = u.id WHERE uf.owner_id = $1 AND ar.status = 'pending' ORDER BY ar.created_at, ar.id`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query access requests")
+		return
+	}
+	defer rows.Close()
+	type AccessRequest struct {
+		ID                  int       `json:"id"`
+		FileID              int       `json:"fileId"`
+		Filename            string    `json:"filename"`
+		RequesterID         int       `json:"requesterId"`
+		RequesterUsername   string    `json:"requesterUsername"`
+		RequesterName       string    `json:"requesterName"`
+		Message             string    `json:"message"`
+		RequestedPermission string    `json:"requestedPermission"`
+		CreatedAt           time.Time `json:"createdAt"`
+	}
+	requests := []AccessRequest{}
+	for rows.Next() {
+		var ar AccessRequest
+		if err := rows.Scan(&ar.ID, &ar.FileID, &ar.Filename, &ar.RequesterID, &ar.RequesterUsername, &ar.RequesterName, &ar.Message, &ar.RequestedPermission, &ar.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan access request")
+			return
+		}
+		requests = append(requests, ar)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"requests": requests})
+}
+
+// The requester asked for the file, so the share skips the invitation step.
+func approveAccessRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	requestID, err := strconv.Atoi(mux.Vars(r)["requestId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request ID")
+		return
+	}
+	var req struct {
+		Permission string     `json:"permission"`
+		ExpiresAt  *time.Time `json:"expiresAt"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Permission != "" {
+		if _, ok := sharePermissionRank[req.Permission]; !ok {
+			writeError(w, http.StatusBadRequest, "permission must be one of viewer, downloader, editor or co-owner")
+			return
+		}
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		writeError(w, http.StatusBadRequest, "expiresAt must be in the future")
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var fileID, requesterID int
+	var filename, permission string
+	err = tx.QueryRow(ctx, `UPDATE access_requests ar SET status = 'approved', permission = COALESCE(NULLIF($3, ''), ar.permission), resolved_at = NOW(), resolved_by = $2 FROM user_files uf WHERE uf.id = ar.user_file_id AND ar.id = $1 AND uf.owner_id = $2 AND ar.status = 'pending' RETURNING uf.id, uf.filename, ar.requester_id, ar.permission`, requestID, user.ID, req.Permission).Scan(&fileID, &filename, &requesterID, &permission)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Access request not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to approve access request")
+		return
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO file_shares (user_file_id, recipient_id, permission, expires_at, status, shared_by) VALUES ($1, $2, $3, $4, 'accepted', $5) ON CONFLICT (user_file_id, recipient_id) DO UPDATE SET permission = EXCLUDED.permission, expires_at = EXCLUDED.expires_at, status = 'accepted', shared_by = EXCLUDED.shared_by, shared_at = NOW()`, fileID, requesterID, permission, req.ExpiresAt, user.ID); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to share file")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	logAuditEvent(ctx, user.ID, fileID, "ACCESS_REQUEST_APPROVE", map[string]interface{}{"requestId": requestID, "filename": filename, "requesterId": requesterID, "permission": permission, "expiresAt": req.ExpiresAt})
+	logAuditEvent(ctx, requesterID, fileID, "ACCESS_REQUEST_APPROVED", map[string]interface{}{"requestId": requestID, "filename": filename, "permission": permission, "expiresAt": req.ExpiresAt})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Access request approved", "permission": permission, "expiresAt": req.ExpiresAt})
+}
+
+func denyAccessRequestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	requestID, err := strconv.Atoi(mux.Vars(r)["requestId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid request ID")
+		return
+	}
+	var fileID, requesterID int
+	err = pool.QueryRow(ctx, `UPDATE access_requests ar SET status = 'denied', resolved_at = NOW(), resolved_by = $2 FROM user_files uf WHERE uf.id = ar.user_file_id AND ar.id = $1 AND uf.owner_id = $2 AND ar.status = 'pending' RETURNING uf.id, ar.requester_id`, requestID, user.ID).Scan(&fileID, &requesterID)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "Access request not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to deny access request")
+		return
+	}
+	logAuditEvent(ctx, user.ID, fileID, "ACCESS_REQUEST_DENY", map[string]interface{}{"requestId": requestID, "requesterId": requesterID})
+	logAuditEvent(ctx, requesterID, fileID, "ACCESS_REQUEST_DENIED", map[string]interface{}{"requestId": requestID})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Access request denied"})
+}
+
+func updateSharePermissionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	recipientID, err := strconv.Atoi(vars["recipientId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid recipient ID")
+		return
+	}
+	var req struct {
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if _, ok := sharePermissionRank[req.Permission]; !ok {
+		writeError(w, http.StatusBadRequest, "permission must be one of viewer, downloader, editor or co-owner")
+		return
+	}
+	filename, ok := ownedFilename(ctx, w, userFileID, user.ID)
+	if !ok {
+		return
+	}
+	var previous, recipientUsername string
+	err = pool.QueryRow(ctx, `UPDATE file_shares fs SET permission = $3 FROM file_shares old, users u WHERE fs.id = old.id AND u.id = fs.recipient_id AND fs.user_file_id = $1 AND fs.recipient_id = $2 AND `+unexpiredShareCondition+` RETURNING old.permission, u.username`, userFileID, recipientID, req.Permission).Scan(&previous, &recipientUsername)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "File is not shared with this user")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to update share permission")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_PERMISSION_CHANGE", map[string]interface{}{"filename": filename, "recipientId": recipientID, "recipientUsername": recipientUsername, "from": previous, "to": req.Permission})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Share permission updated", "recipientId": recipientID, "permission": req.Permission})
+}
+
+func ownedFilename(ctx context.Context, w http.ResponseWriter, userFileID, userID int) (string, bool) {
+	var ownerID int
+	var filename string
+	err := pool.QueryRow(ctx, "SELECT owner_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &filename)
+	if err != nil {
+		writeError(w, http.StatusNotFound, "File not found")
+		return "", false
+	}
+	if ownerID != userID {
+		writeError(w, http.StatusForbidden, "You are not the owner of this file")
+		return "", false
+	}
+	return filename, true
+}
+
+func revokeShareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	vars := mux.Vars(r)
+	userFileID, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	recipientID, err := strconv.Atoi(vars["recipientId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid recipient ID")
+		return
+	}
+	filename, ok := ownedFilename(ctx, w, userFileID, user.ID)
+	if !ok {
+		return
+	}
+	var recipientUsername string
+	err = pool.QueryRow(ctx, `DELETE FROM file_shares fs USING users u WHERE u.id = fs.recipient_id AND fs.user_file_id = $1 AND fs.recipient_id = $2 RETURNING u.username`, userFileID, recipientID).Scan(&recipientUsername)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "File is not shared with this user")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to revoke share")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_REVOKE", map[string]interface{}{"filename": filename, "recipientId": recipientID, "recipientUsername": recipientUsername})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": fmt.Sprintf("Access revoked for %s", recipientUsername), "recipientId": recipientID})
+}
+
+func revokeAllSharesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	filename, ok := ownedFilename(ctx, w, userFileID, user.ID)
+	if !ok {
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `DELETE FROM file_shares fs USING users u WHERE u.id = fs.recipient_id AND fs.user_file_id = $1 RETURNING fs.recipient_id, u.username`, userFileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	defer rows.Close()
+	type RevokedRecipient struct {
+		ID       int    `json:"id"`
+		Username string `json:"username"`
+	}
+	revoked := []RevokedRecipient{}
+	for rows.Next() {
+		var rr RevokedRecipient
+		if err := rows.Scan(&rr.ID, &rr.Username); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan revoked share")
+			return
+		}
+		revoked = append(revoked, rr)
+	}
+	if err := rows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke shares")
+		return
+	}
+	rows.Close()
+	groupRows, err := tx.Query(ctx, `DELETE FROM group_file_shares gs USING user_groups g WHERE g.id = gs.group_id AND gs.user_file_id = $1 RETURNING g.id, g.name`, userFileID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke group shares")
+		return
+	}
+	defer groupRows.Close()
+	type RevokedGroup struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	revokedGroups := []RevokedGroup{}
+	for groupRows.Next() {
+		var rg RevokedGroup
+		if err := groupRows.Scan(&rg.ID, &rg.Name); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan revoked group share")
+			return
+		}
+		revokedGroups = append(revokedGroups, rg)
+	}
+	if err := groupRows.Err(); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke group shares")
+		return
+	}
+	groupRows.Close()
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	for _, rr := range revoked {
+		logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_REVOKE", map[string]interface{}{"filename": filename, "recipientId": rr.ID, "recipientUsername": rr.Username, "bulk": true})
+	}
+	for _, rg := range revokedGroups {
+		logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_GROUP", map[string]interface{}{"filename": filename, "groupId": rg.ID, "groupName": rg.Name, "bulk": true})
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": fmt.Sprintf("Revoked %d share(s)", len(revoked)+len(revokedGroups)), "revoked": revoked, "revokedGroups": revokedGroups})
+}
+
+const (
+	groupRoleMember = "member"
+	groupRoleAdmin  = "admin"
+)
+
+func groupMembership(ctx context.Context, groupID, userID int) (string, int, error) {
+	var ownerID int
+	var role *string
+	err := pool.QueryRow(ctx, `SELECT g.owner_id, (SELECT gm.role FROM group_members gm WHERE gm.group_id = g.id AND gm.user_id = $2 AND gm.status = 'accepted') FROM user_groups g WHERE g.id = $1`, groupID, userID).Scan(&ownerID, &role)
+	if err != nil {
+		return "", 0, err
+	}
+	if role == nil {
+		return "", ownerID, nil
+	}
+	return *role, ownerID, nil
+}
+
+// Non-members get a 404 so group IDs don't leak.
+func loadGroupForMember(w http.ResponseWriter, r *http.Request, user *AuthenticatedUser) (int, string, int, bool) {
+	groupID, err := strconv.Atoi(mux.Vars(r)["groupId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid group ID")
+		return 0, "", 0, false
+	}
+	role, ownerID, err := groupMembership(r.Context(), groupID, user.ID)
+	if err != nil && err != pgx.ErrNoRows {
+		writeError(w, http.StatusInternalServerError, "Failed to load group")
+		return 0, "", 0, false
+	}
+	if err == pgx.ErrNoRows || role == "" {
+		writeError(w, http.StatusNotFound, "Group not found")
+		return 0, "", 0, false
+	}
+	return groupID, role, ownerID, true
+}
+
+func createGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, http.StatusBadRequest, "Group name is required and must be at most 100 characters")
+		return
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	var groupID int
+	if err := tx.QueryRow(ctx, `INSERT INTO user_groups (name, owner_id) VALUES ($1, $2) RETURNING id`, req.Name, user.ID).Scan(&groupID); err != nil {
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "You already own a group with this name")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to create group")
+		return
+	}
+	if _, err := tx.Exec(ctx, `INSERT INTO group_members (group_id, user_id, role) VALUES ($1, $2, $3)`, groupID, user.ID, groupRoleAdmin); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to add group owner")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	logAuditEvent(ctx, user.ID, 0, "GROUP_CREATE", map[string]interface{}{"groupId": groupID, "name": req.Name})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"id": groupID, "name": req.Name, "ownerId": user.ID, "role": groupRoleAdmin})
+}
+
+func listGroupsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	rows, err := pool.Query(ctx, `SELECT g.id, g.name, g.owner_id, u.username, gm.role, (SELECT COUNT(*) FROM group_members m WHERE m.group_id = g.id AND m.status = 'accepted'), g.created_at FROM group_members gm JOIN user_groups g ON gm.group_id = g.id JOIN users u ON g.owner_id = u.id WHERE gm.user_id = $1 AND gm.status = 'accepted' ORDER BY LOWER(g.name), g.id`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query groups")
+		return
+	}
+	defer rows.Close()
+	type GroupInfo struct {
+		ID            int       `json:"id"`
+		Name          string    `json:"name"`
+		OwnerID       int       `json:"ownerId"`
+		OwnerUsername string    `json:"ownerUsername"`
+		Role          string    `json:"role"`
+		MemberCount   int       `json:"memberCount"`
+		CreatedAt     time.Time `json:"createdAt"`
+	}
+	groups := []GroupInfo{}
+	for rows.Next() {
+		var g GroupInfo
+		if err := rows.Scan(&g.ID, &g.Name, &g.OwnerID, &g.OwnerUsername, &g.Role, &g.MemberCount, &g.CreatedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan group")
+			return
+		}
+		groups = append(groups, g)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"groups": groups})
+}
+
+func getGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	groupID, role, ownerID, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
+	}
+	var name string
+	if err := pool.QueryRow(ctx, `SELECT name FROM user_groups WHERE id = $1`, groupID).Scan(&name); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to load group")
+		return
+	}
+	rows, err := pool.Query(ctx, `SELECT u.id, u.username, u.name, gm.role, gm.status, gm.added_at FROM group_members gm JOIN users u ON gm.user_id = u.id WHERE gm.group_id = $1 ORDER BY gm.status, gm.role, LOWER(u.username)`, groupID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query group members")
+		return
+	}
+	defer rows.Close()
+	type GroupMember struct {
+		ID       int       `json:"id"`
+		Username string    `json:"username"`
+		Name     string    `json:"name"`
+		Role     string    `json:"role"`
+		Status   string    `json:"status"`
+		IsOwner  bool      `json:"isOwner"`
+		AddedAt  time.Time `json:"addedAt"`
+	}
+	members := []GroupMember{}
+	for rows.Next() {
+		var m GroupMember
+		if err := rows.Scan(&m.ID, &m.Username, &m.Name, &m.Role, &m.Status, &m.AddedAt); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan group member")
+			return
+		}
+		m.IsOwner = m.ID == ownerID
+		members = append(members, m)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"id": groupID, "name": name, "ownerId": ownerID, "role": role, "members": members})
+}
+
+func renameGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	groupID, role, _, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
+	}
+	if role != groupRoleAdmin {
+		writeError(w, http.StatusForbidden, "Only group admins can rename the group")
+		return
+	}
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" || len(req.Name) > 100 {
+		writeError(w, http.StatusBadRequest, "Group name is required and must be at most 100 characters")
+		return
+	}
+	if _, err := pool.Exec(ctx, `UPDATE user_groups SET name = $2 WHERE id = $1`, groupID, req.Name); err != nil {
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "The group owner already has a group with this name")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to rename group")
+		return
+	}
+	logAuditEvent(ctx, user.ID, 0, "GROUP_RENAME", map[string]interface{}{"groupId": groupID, "name": req.Name})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Group renamed", "id": groupID, "name": req.Name})
+}
+
+func deleteGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	groupID, _, ownerID, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
 	}
-	if req.Filters.StartDate != nil {
-		conditions = append(conditions, fmt.Sprintf("uf.uploaded_at >= $%d", argID))
-		args = append(args, *req.Filters.StartDate)
-		argID++
+	if ownerID != user.ID {
+		writeError(w, http.StatusForbidden, "Only the group owner can delete the group")
+		return
 	}
-	if req.Filters.EndDate != nil {
-		conditions = append(conditions, fmt.Sprintf("uf.uploaded_at <= $%d", argID))
-		args = append(args, *req.Filters.EndDate)
-		argID++
+	var name string
+	if err := pool.QueryRow(ctx, `DELETE FROM user_groups WHERE id = $1 RETURNING name`, groupID).Scan(&name); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to delete group")
+		return
 	}
-	finalQuery := baseQuery
-	if len(conditions) > 0 {
-		finalQuery += " AND " + strings.Join(conditions, " AND ")
+	logAuditEvent(ctx, user.ID, 0, "GROUP_DELETE", map[string]interface{}{"groupId": groupID, "name": name})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Group deleted"})
+}
+
+func addGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	groupID, role, ownerID, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
 	}
-	finalQuery += ` ORDER BY uf.uploaded_at DESC`
-	rows, err := pool.Query(ctx, finalQuery, args...)
+	if role != groupRoleAdmin {
+		writeError(w, http.StatusForbidden, "Only group admins can add members")
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Role == "" {
+		req.Role = groupRoleMember
+	}
+	if req.Role != groupRoleMember && req.Role != groupRoleAdmin {
+		writeError(w, http.StatusBadRequest, "role must be 'member' or 'admin'")
+		return
+	}
+	if req.Role == groupRoleAdmin && ownerID != user.ID {
+		writeError(w, http.StatusForbidden, "Only the group owner can add admins")
+		return
+	}
+	var memberID int
+	if err := pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", req.Username).Scan(&memberID); err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "User not found")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Database error")
+		return
+	}
+	status, err := shareStatusFor(ctx, memberID, user.ID)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to query files: "+err.Error())
+		writeError(w, http.StatusInternalServerError, "Failed to read recipient's sharing preferences")
 		return
 	}
-	defer rows.Close()
-	type FileInfo struct {
-		ID            int        `json:"id"`
-		Filename      string     `json:"filename"`
-		Size          int64      `json:"size"`
-		MimeType      string     `json:"mimeType"`
-		IsPublic      bool       `json:"isPublic"`
-		DownloadCount int        `json:"downloadCount"`
-		UploadedAt    time.Time  `json:"uploadedAt"`
-		URL           string     `json:"url"`
-		OwnerName     string     `json:"ownerName"`
-		RefCount      int        `json:"refCount"`
-		SharedBy      *string    `json:"sharedBy,omitempty"`
+	if status == shareStatusPending {
+		declined, err := recentlyDeclinedSender(ctx, memberID, user.ID)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to read recipient's sharing preferences")
+			return
+		}
+		if declined {
+			writeError(w, http.StatusTooManyRequests, "This user declined an invitation from you recently; try again later")
+			return
+		}
 	}
-	var files []FileInfo
-	for rows.Next() {
-		var f FileInfo
-		if err := rows.Scan(&f.ID, &f.Filename, &f.Size, &f.MimeType, &f.IsPublic, &f.DownloadCount, &f.UploadedAt, &f.URL, &f.OwnerName, &f.RefCount, &f.SharedBy); err != nil {
-			writeError(w, http.StatusInternalServerError, "Failed to scan file data: "+err.Error())
+	if _, err := pool.Exec(ctx, `INSERT INTO group_members (group_id, user_id, role, status, added_by) VALUES ($1, $2, $3, $4, $5)`, groupID, memberID, req.Role, status, user.ID); err != nil {
+		if strings.Contains(err.Error(), "23505") {
+			writeError(w, http.StatusConflict, "User is already a member of this group or has a pending invitation")
 			return
 		}
-		f.URL = sanitizeCloudinaryURL(f.URL)
-		files = append(files, f)
+		writeError(w, http.StatusInternalServerError, "Failed to add group member")
+		return
 	}
-	writeJSON(w, http.StatusOK, files)
+	logAuditEvent(ctx, user.ID, 0, "GROUP_MEMBER_ADD", map[string]interface{}{"groupId": groupID, "memberId": memberID, "memberUsername": req.Username, "role": req.Role, "status": status})
+	message := fmt.Sprintf("%s added to the group", req.Username)
+	if status == shareStatusPending {
+		logAuditEvent(ctx, memberID, 0, "GROUP_INVITATION_RECEIVED", map[string]interface{}{"groupId": groupID, "senderId": user.ID})
+		message = fmt.Sprintf("%s has been invited to the group", req.Username)
+	}
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": message, "userId": memberID, "role": req.Role, "status": status})
 }
 
-func listMySharedFilesHandler(w http.ResponseWriter, r *http.Request) {
+func updateGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	query := `SELECT uf.id, uf.filename, pf.size, pf.mime_type, uf.is_public, uf.download_count, uf.uploaded_at, pf.storage_url, u_owner.name AS owner_name, COALESCE((SELECT jsonb_agg(jsonb_build_object('id', u_recipient.id, 'username', u_recipient.username, 'name', u_recipient.name)) FROM file_shares fs JOIN users u_recipient ON fs.recipient_id = u_recipient.id WHERE fs.user_file_id = uf.id), '[]'::jsonb) AS shared_with FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id WHERE uf.owner_id = $1 AND (uf.is_public = TRUE OR EXISTS (SELECT 1 FROM file_shares fs WHERE fs.user_file_id = uf.id)) ORDER BY uf.uploaded_at DESC;`
-	rows, err := pool.Query(ctx, query, user.ID)
+	groupID, _, ownerID, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userId"])
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to query shared files: "+err.Error())
+		writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if ownerID != user.ID {
+		writeError(w, http.StatusForbidden, "Only the group owner can change member roles")
+		return
+	}
+	if memberID == ownerID {
+		writeError(w, http.StatusBadRequest, "The group owner is always an admin")
+		return
+	}
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Role != groupRoleMember && req.Role != groupRoleAdmin {
+		writeError(w, http.StatusBadRequest, "role must be 'member' or 'admin'")
+		return
+	}
+	tag, err := pool.Exec(ctx, `UPDATE group_members SET role = $3 WHERE group_id = $1 AND user_id = $2`, groupID, memberID, req.Role)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to update member role")
+		return
+	}
+	if tag.RowsAffected() == 0 {
+		writeError(w, http.StatusNotFound, "User is not a member of this group")
+		return
+	}
+	logAuditEvent(ctx, user.ID, 0, "GROUP_MEMBER_ROLE_CHANGE", map[string]interface{}{"groupId": groupID, "memberId": memberID, "role": req.Role})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "Member role updated", "userId": memberID, "role": req.Role})
+}
+
+func removeGroupMemberHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	groupID, role, ownerID, ok := loadGroupForMember(w, r, user)
+	if !ok {
+		return
+	}
+	memberID, err := strconv.Atoi(mux.Vars(r)["userId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid user ID")
+		return
+	}
+	if memberID == ownerID {
+		writeError(w, http.StatusBadRequest, "The group owner cannot be removed; delete the group instead")
+		return
+	}
+	var targetRole, targetStatus string
+	if err := pool.QueryRow(ctx, `SELECT role, status FROM group_members WHERE group_id = $1 AND user_id = $2`, groupID, memberID).Scan(&targetRole, &targetStatus); err != nil {
+		writeError(w, http.StatusNotFound, "User is not a member of this group")
+		return
+	}
+	if memberID != user.ID {
+		if role != groupRoleAdmin {
+			writeError(w, http.StatusForbidden, "Only group admins can remove members")
+			return
+		}
+		if targetRole == groupRoleAdmin && ownerID != user.ID {
+			writeError(w, http.StatusForbidden, "Only the group owner can remove admins")
+			return
+		}
+	}
+	if _, err := pool.Exec(ctx, `DELETE FROM group_members WHERE group_id = $1 AND user_id = $2`, groupID, memberID); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to remove group member")
+		return
+	}
+	logAuditEvent(ctx, user.ID, 0, "GROUP_MEMBER_REMOVE", map[string]interface{}{"groupId": groupID, "memberId": memberID, "left": memberID == user.ID, "status": targetStatus})
+	writeJSON(w, http.StatusOK, map[string]string{"message": "Member removed from the group"})
+}
+
+func listGroupInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	rows, err := pool.Query(ctx, `SELECT g.id, g.name, u_owner.username, gm.role, gm.added_at, gm.added_by, COALESCE(u_sender.username, '') FROM group_members gm JOIN user_groups g ON gm.group_id = g.id JOIN users u_owner ON g.owner_id = u_owner.id LEFT JOIN users u_sender ON gm.added_by = u_sender.id WHERE gm.user_id = $1 AND gm.status = 'pending' ORDER BY gm.added_at DESC, g.id DESC`, user.ID)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to query group invitations")
 		return
 	}
 	defer rows.Close()
-	type SharedFileInfo struct {
-		ID            int             `json:"id"`
-		Filename      string          `json:"filename"`
-		Size          int64           `json:"size"`
-		MimeType      string          `json:"mimeType"`
-		IsPublic      bool            `json:"isPublic"`
-		DownloadCount int             `json:"downloadCount"`
-		UploadedAt    time.Time       `json:"uploadedAt"`
-		URL           string          `json:"url"`
-		OwnerName     string          `json:"ownerName"`
-		SharedWith    json.RawMessage `json:"sharedWith"`
+	type GroupInvitation struct {
+		GroupID        int       `json:"groupId"`
+		GroupName      string    `json:"groupName"`
+		OwnerUsername  string    `json:"ownerUsername"`
+		Role           string    `json:"role"`
+		InvitedAt      time.Time `json:"invitedAt"`
+		SenderID       *int      `json:"senderId"`
+		SenderUsername string    `json:"senderUsername"`
 	}
-	var files []SharedFileInfo
+	invitations := []GroupInvitation{}
 	for rows.Next() {
-		var f SharedFileInfo
-		if err := rows.Scan(&f.ID, &f.Filename, &f.Size, &f.MimeType, &f.IsPublic, &f.DownloadCount, &f.UploadedAt, &f.URL, &f.OwnerName, &f.SharedWith); err != nil {
-			writeError(w, http.StatusInternalServerError, "Failed to scan shared file data: "+err.Error())
+		var inv GroupInvitation
+		if err := rows.Scan(&inv.GroupID, &inv.GroupName, &inv.OwnerUsername, &inv.Role, &inv.InvitedAt, &inv.SenderID, &inv.SenderUsername); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to scan group invitation")
 			return
 		}
-		f.URL = sanitizeCloudinaryURL(f.URL)
-		files = append(files, f)
+		invitations = append(invitations, inv)
 	}
-	writeJSON(w, http.StatusOK, files)
+	writeJSON(w, http.StatusOK, map[string]interface{}{"invitations": invitations})
 }
 
-func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
+func respondGroupInvitationHandler(accept bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		user := ctx.Value(userContextKey).(*AuthenticatedUser)
+		groupID, err := strconv.Atoi(mux.Vars(r)["groupId"])
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "Invalid group ID")
+			return
+		}
+		query := `UPDATE group_members SET status = 'accepted', added_at = NOW() WHERE group_id = $1 AND user_id = $2 AND status = 'pending' RETURNING added_by`
+		if !accept {
+			query = `WITH declined AS (DELETE FROM group_members WHERE group_id = $1 AND user_id = $2 AND status = 'pending' RETURNING added_by AS shared_by), recorded AS (` + recordDeclinedSenderSQL + `) SELECT shared_by FROM declined`
+		}
+		var senderID *int
+		if err := pool.QueryRow(ctx, query, groupID, user.ID).Scan(&senderID); err != nil {
+			if err == pgx.ErrNoRows {
+				writeError(w, http.StatusNotFound, "Invitation not found")
+				return
+			}
+			writeError(w, http.StatusInternalServerError, "Failed to update invitation")
+			return
+		}
+		action, message := "GROUP_INVITATION_DECLINE", "Invitation declined"
+		if accept {
+			action, message = "GROUP_INVITATION_ACCEPT", "Invitation accepted"
+			if senderID != nil {
+				if _, err := pool.Exec(ctx, `INSERT INTO trusted_share_senders (user_id, sender_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, user.ID, *senderID); err != nil {
+					log.Printf("Failed to record trusted sender %d for user %d: %v", *senderID, user.ID, err)
+				}
+			}
+		}
+		logAuditEvent(ctx, user.ID, 0, action, map[string]interface{}{"groupId": groupID, "senderId": senderID})
+		writeJSON(w, http.StatusOK, map[string]interface{}{"message": message, "groupId": groupID})
+	}
+}
+
+func shareWithGroupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var req struct {
+		GroupID    int    `json:"groupId"`
+		Permission string `json:"permission"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	if req.Permission == "" {
+		req.Permission = sharePermissionDownloader
+	}
+	if _, ok := sharePermissionRank[req.Permission]; !ok {
+		writeError(w, http.StatusBadRequest, "permission must be one of viewer, downloader, editor or co-owner")
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	if req.Permission == sharePermissionCoOwner {
+		var ownerID int
+		if err := pool.QueryRow(ctx, "SELECT owner_id FROM user_files WHERE id = $1", userFileID).Scan(&ownerID); err != nil || ownerID != user.ID {
+			writeError(w, http.StatusForbidden, "Only the file owner can grant co-owner access")
+			return
+		}
+	}
+	role, _, err := groupMembership(ctx, req.GroupID, user.ID)
+	if err != nil || role == "" {
+		writeError(w, http.StatusNotFound, "Group not found")
+		return
+	}
+	var groupName string
+	err = pool.QueryRow(ctx, `INSERT INTO group_file_shares (user_file_id, group_id, permission, shared_by) VALUES ($1, $2, $3, $4) ON CONFLICT (user_file_id, group_id) DO UPDATE SET permission = EXCLUDED.permission RETURNING (SELECT name FROM user_groups WHERE id = $2)`, userFileID, req.GroupID, req.Permission, user.ID).Scan(&groupName)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to share file with group")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_GROUP", map[string]interface{}{"filename": filename, "groupId": req.GroupID, "groupName": groupName, "permission": req.Permission})
+	writeJSON(w, http.StatusCreated, map[string]interface{}{"message": fmt.Sprintf("File shared with group %s", groupName), "groupId": req.GroupID, "permission": req.Permission})
+}
+
+func unshareGroupHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userContextKey).(*AuthenticatedUser)
 	vars := mux.Vars(r)
@@ -648,185 +4826,420 @@ func deleteFileHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "Invalid file ID")
 		return
 	}
+	groupID, err := strconv.Atoi(vars["groupId"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid group ID")
+		return
+	}
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
+		return
+	}
+	var groupName string
+	err = pool.QueryRow(ctx, `DELETE FROM group_file_shares gs USING user_groups g WHERE g.id = gs.group_id AND gs.user_file_id = $1 AND gs.group_id = $2 RETURNING g.name`, userFileID, groupID).Scan(&groupName)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			writeError(w, http.StatusNotFound, "File is not shared with this group")
+			return
+		}
+		writeError(w, http.StatusInternalServerError, "Failed to remove group share")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_GROUP", map[string]interface{}{"filename": filename, "groupId": groupID, "groupName": groupName})
+	writeJSON(w, http.StatusOK, map[string]string{"message": fmt.Sprintf("File no longer shared with group %s", groupName)})
+}
+
+func renameFileHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	userFileID, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		return
+	}
+	var req struct {
+		Filename string `json:"filename"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	newName := sanitizeFilename(req.Filename)
+	if strings.TrimSpace(req.Filename) == "" {
+		writeError(w, http.StatusBadRequest, "filename is required")
+		return
+	}
 	tx, err := pool.Begin(ctx)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Could not start transaction")
 		return
 	}
 	defer tx.Rollback(ctx)
-	var ownerID, physicalFileID int
-	var filename string
-	err = tx.QueryRow(ctx, "SELECT owner_id, physical_file_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &physicalFileID, &filename)
+	var ownerID int
+	var oldName string
+	var permission *string
+	err = tx.QueryRow(ctx, "SELECT owner_id, filename, "+sharePermissionExpr("$1", "$2")+" FROM user_files WHERE id = $1 FOR UPDATE", userFileID, user.ID).Scan(&ownerID, &oldName, &permission)
 	if err != nil {
 		writeError(w, http.StatusNotFound, "File not found")
 		return
 	}
-	if ownerID != user.ID && user.Role != "admin" {
-		writeError(w, http.StatusForbidden, "You do not have permission to delete this file")
+	if !canAccessFile(user, ownerID, permission, sharePermissionEditor) {
+		writeError(w, http.StatusForbidden, "You do not have permission to rename this file")
+		return
+	}
+	if newName == oldName {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"message": "File renamed", "id": userFileID, "filename": newName})
+		return
+	}
+	var taken bool
+	if err := tx.QueryRow(ctx, "SELECT EXISTS(SELECT 1 FROM user_files WHERE owner_id = $1 AND filename = $2 AND id <> $3)", ownerID, newName, userFileID).Scan(&taken); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to check for filename conflict")
+		return
+	}
+	if taken {
+		writeError(w, http.StatusConflict, fmt.Sprintf("A file named %q already exists", newName))
+		return
+	}
+	if _, err := tx.Exec(ctx, "UPDATE user_files SET filename = $2 WHERE id = $1", userFileID, newName); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to rename file")
+		return
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
 		return
 	}
-	_, err = tx.Exec(ctx, "DELETE FROM user_files WHERE id = $1", userFileID)
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_RENAME", map[string]interface{}{"from": oldName, "to": newName, "ownerId": ownerID})
+	writeJSON(w, http.StatusOK, map[string]interface{}{"message": "File renamed", "id": userFileID, "filename": newName})
+}
+
+const (
+	renditionStatusPending     = "pending"
+	renditionStatusReady       = "ready"
+	renditionStatusUnsupported = "unsupported"
+	renditionStatusFailed      = "failed"
+)
+
+type renditionSize struct {
+	Name   string
+	Pixels int
+}
+
+var renditionSizes = []renditionSize{{"large", 1024}, {"medium", 512}, {"small", 128}}
+
+const (
+	maxRenditionSourcePixels = 50 * 1000 * 1000
+	maxRenditionSourceBytes  = 64 << 20
+	renditionTimeout         = 2 * time.Minute
+)
+
+var errRenditionSourceTooLarge = fmt.Errorf("source exceeds the %d byte rendition limit", maxRenditionSourceBytes)
+
+func readRenditionSource(body io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(body, maxRenditionSourceBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxRenditionSourceBytes {
+		return nil, errRenditionSourceTooLarge
+	}
+	return data, nil
+}
+
+func isRenderableMIME(mimeType string) bool {
+	switch baseMIME(mimeType) {
+	case "image/png", "image/jpeg", "image/gif", "application/pdf":
+		return true
+	}
+	return false
+}
+
+func resizeToFit(src image.Image, maxDim int) image.Image {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxDim && h <= maxDim {
+		return src
+	}
+	scale := float64(w) / float64(maxDim)
+	if h > w {
+		scale = float64(h) / float64(maxDim)
+	}
+	dw, dh := int(float64(w)/scale), int(float64(h)/scale)
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := b.Min.Y+y*h/dh, b.Min.Y+(y+1)*h/dh
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := b.Min.X+x*w/dw, b.Min.X+(x+1)*w/dw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			var rs, gs, bs, as, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					r, g, bl, a := src.At(sx, sy).RGBA()
+					rs, gs, bs, as = rs+uint64(r), gs+uint64(g), bs+uint64(bl), as+uint64(a)
+					n++
+				}
+			}
+			dst.SetRGBA64(x, y, color.RGBA64{R: uint16(rs / n), G: uint16(gs / n), B: uint16(bs / n), A: uint16(as / n)})
+		}
+	}
+	return dst
+}
+
+func stagePDF(pdf io.Reader) (string, string, error) {
+	dir, err := os.MkdirTemp("", "keyvia-pdf-")
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to delete file reference")
-		return
+		return "", "", fmt.Errorf("could not create staging directory: %w", err)
 	}
-	var refCount int
-	var publicID string
-	err = tx.QueryRow(ctx, "UPDATE physical_files SET ref_count = ref_count - 1 WHERE id = $1 RETURNING ref_count, public_id", physicalFileID).Scan(&refCount, &publicID)
+	input := filepath.Join(dir, "input.pdf")
+	f, err := os.Create(input)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to update file reference count")
-		return
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("could not stage pdf: %w", err)
 	}
-	if refCount == 0 {
-		_, err := cld.Upload.Destroy(ctx, uploader.DestroyParams{PublicID: publicID})
-		if err != nil {
-			log.Printf("Orphaned file warning: Could not delete file %s from Cloudinary: %v", publicID, err)
-		}
-		_, err = tx.Exec(ctx, "DELETE FROM physical_files WHERE id = $1", physicalFileID)
-		if err != nil {
-			writeError(w, http.StatusInternalServerError, "Failed to delete physical file record")
-			return
-		}
+	defer f.Close()
+	n, err := io.Copy(f, io.LimitReader(pdf, maxRenditionSourceBytes+1))
+	if err == nil && n > maxRenditionSourceBytes {
+		err = errRenditionSourceTooLarge
 	}
-	if err := tx.Commit(ctx); err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
-		return
+	if err != nil {
+		os.RemoveAll(dir)
+		return "", "", fmt.Errorf("could not stage pdf: %w", err)
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_DELETE", map[string]interface{}{"filename": filename})
-	writeJSON(w, http.StatusOK, map[string]string{"message": "File deleted successfully"})
+	return dir, input, nil
 }
 
-func unshareFileHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	vars := mux.Vars(r)
-	userFileID, err := strconv.Atoi(vars["id"])
+func renderPDFFirstPage(ctx context.Context, pdf io.Reader, maxDim int) (image.Image, error) {
+	dir, input, err := stagePDF(pdf)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid file ID")
-		return
+		return nil, err
 	}
-	_, err = pool.Exec(ctx, "DELETE FROM file_shares WHERE user_file_id = $1 AND recipient_id = $2", userFileID, user.ID)
+	defer os.RemoveAll(dir)
+	outputRoot := filepath.Join(dir, "page")
+	cmd := exec.CommandContext(ctx, appConfig.PdfRendererPath, "-png", "-f", "1", "-l", "1", "-singlefile", "-scale-to", strconv.Itoa(maxDim), input, outputRoot)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("pdf renderer failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	rendered, err := os.Open(outputRoot + ".png")
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to remove share")
-		return
+		return nil, fmt.Errorf("pdf renderer produced no output: %w", err)
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_SELF", nil)
-	writeJSON(w, http.StatusOK, map[string]string{"message": "File removed from your view"})
+	defer rendered.Close()
+	return png.Decode(rendered)
 }
 
-func shareFileHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	vars := mux.Vars(r)
-	userFileID, err := strconv.Atoi(vars["id"])
+func decodeRenditionSource(ctx context.Context, body io.Reader, mimeType string) (image.Image, error) {
+	if baseMIME(mimeType) == "application/pdf" {
+		return renderPDFFirstPage(ctx, body, renditionSizes[0].Pixels)
+	}
+	data, err := readRenditionSource(body)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid file ID")
-		return
+		return nil, fmt.Errorf("could not read image: %w", err)
 	}
-	var ownerID int
-	var filename string
-	err = pool.QueryRow(ctx, "SELECT owner_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &filename)
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
 	if err != nil {
-		writeError(w, http.StatusNotFound, "File not found")
-		return
+		return nil, fmt.Errorf("could not read image dimensions: %w", err)
 	}
-	if ownerID != user.ID {
-		writeError(w, http.StatusForbidden, "You are not the owner of this file")
-		return
+	if cfg.Width*cfg.Height > maxRenditionSourcePixels {
+		return nil, fmt.Errorf("image too large to render (%dx%d)", cfg.Width, cfg.Height)
 	}
-	_, err = pool.Exec(ctx, "UPDATE user_files SET is_public = true WHERE id = $1", userFileID)
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Failed to make file public")
-		return
+		return nil, fmt.Errorf("could not decode image: %w", err)
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_PUBLIC", map[string]interface{}{"filename": filename})
-	publicLink := fmt.Sprintf("%s://%s/files/public/%d", "http", r.Host, userFileID)
-	writeJSON(w, http.StatusOK, map[string]string{"message": "File is now public", "publicLink": publicLink})
+	return img, nil
 }
 
-func publicDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	vars := mux.Vars(r)
-	userFileID, err := strconv.Atoi(vars["id"])
+func generateRenditions(ctx context.Context, hash, storageURL, mimeType string) error {
+	ctx, cancel := context.WithTimeout(ctx, renditionTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, storageURL, nil)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid file ID")
-		return
+		return fmt.Errorf("could not build storage request: %w", err)
 	}
-	tx, err := pool.Begin(ctx)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Database error")
-		return
+		return fmt.Errorf("could not fetch file from storage: %w", err)
 	}
-	defer tx.Rollback(ctx)
-	var isPublic bool
-	var storageURL, filename string
-	query := `SELECT uf.is_public, pf.storage_url, uf.filename FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = $1`
-	err = tx.QueryRow(ctx, query, userFileID).Scan(&isPublic, &storageURL, &filename)
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storage returned status %d", resp.StatusCode)
+	}
+	src, err := decodeRenditionSource(ctx, resp.Body, mimeType)
 	if err != nil {
-		writeError(w, http.StatusNotFound, "File not found")
-		return
+		return err
 	}
-	if !isPublic {
-		writeError(w, http.StatusForbidden, "This file is not public")
-		return
+	for _, size := range renditionSizes {
+		thumb := resizeToFit(src, size.Pixels)
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, thumb); err != nil {
+			return fmt.Errorf("could not encode %s rendition: %w", size.Name, err)
+		}
+		publicID := fmt.Sprintf("renditions/%s_%s", hash, size.Name)
+		uploadResult, err := cld.Upload.Upload(ctx, &buf, uploader.UploadParams{ResourceType: "image", Type: "upload", PublicID: publicID})
+		if err != nil {
+			return fmt.Errorf("could not store %s rendition: %w", size.Name, err)
+		}
+		_, err = pool.Exec(ctx, `INSERT INTO file_renditions (physical_hash, size, storage_url, public_id, width, height) VALUES ($1, $2, $3, $4, $5, $6) ON CONFLICT (physical_hash, size) DO UPDATE SET storage_url = EXCLUDED.storage_url, public_id = EXCLUDED.public_id, width = EXCLUDED.width, height = EXCLUDED.height`, hash, size.Name, uploadResult.SecureURL, uploadResult.PublicID, thumb.Bounds().Dx(), thumb.Bounds().Dy())
+		if err != nil {
+			return fmt.Errorf("could not record %s rendition: %w", size.Name, err)
+		}
 	}
-	_, err = tx.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", userFileID)
-	if err != nil {
-		log.Printf("Failed to increment download count for file %d: %v", userFileID, err)
+	return nil
+}
+
+func processPendingRenditions(ctx context.Context) {
+	type PendingRendition struct {
+		ID         int
+		Hash       string
+		StorageURL string
+		MimeType   string
 	}
-	if err := tx.Commit(ctx); err != nil {
-		writeError(w, http.StatusInternalServerError, "Database error")
+	rows, err := pool.Query(ctx, `SELECT id, hash, storage_url, mime_type FROM physical_files WHERE rendition_status = 'pending' AND scan_status = 'clean' ORDER BY id LIMIT 20`)
+	if err != nil {
+		log.Printf("Failed to query pending renditions: %v", err)
 		return
 	}
-	logAuditEvent(ctx, 0, userFileID, "FILE_DOWNLOAD_PUBLIC", map[string]interface{}{"ip": r.RemoteAddr, "filename": filename})
-	http.Redirect(w, r, storageURL, http.StatusFound)
+	var pending []PendingRendition
+	for rows.Next() {
+		var p PendingRendition
+		if err := rows.Scan(&p.ID, &p.Hash, &p.StorageURL, &p.MimeType); err != nil {
+			log.Printf("Failed to scan pending rendition row: %v", err)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	for _, p := range pending {
+		status := renditionStatusReady
+		if !isRenderableMIME(p.MimeType) {
+			status = renditionStatusUnsupported
+		} else if err := generateRenditions(ctx, p.Hash, p.StorageURL, p.MimeType); err != nil {
+			log.Printf("Rendition generation failed for physical file %d: %v", p.ID, err)
+			status = renditionStatusFailed
+		}
+		if _, err := pool.Exec(ctx, "UPDATE physical_files SET rendition_status = $1 WHERE id = $2", status, p.ID); err != nil {
+			log.Printf("Failed to record rendition status for physical file %d: %v", p.ID, err)
+		}
+	}
 }
 
-func authenticatedDownloadHandler(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	vars := mux.Vars(r)
-	userFileID, err := strconv.Atoi(vars["id"])
+func indexPendingText(ctx context.Context) {
+	type PendingText struct {
+		ID         int
+		StorageURL string
+		MimeType   string
+	}
+	rows, err := pool.Query(ctx, `SELECT id, storage_url, mime_type FROM physical_files WHERE text_status = 'pending' AND scan_status = 'clean' ORDER BY id LIMIT 20`)
 	if err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid file ID")
+		log.Printf("Failed to query files pending text extraction: %v", err)
 		return
 	}
-	tx, err := pool.Begin(ctx)
+	var pending []PendingText
+	for rows.Next() {
+		var p PendingText
+		if err := rows.Scan(&p.ID, &p.StorageURL, &p.MimeType); err != nil {
+			log.Printf("Failed to scan pending text row: %v", err)
+			continue
+		}
+		pending = append(pending, p)
+	}
+	rows.Close()
+	for _, p := range pending {
+		var text string
+		var extractErr error
+		if isExtractableMIME(p.MimeType) {
+			text, extractErr = fetchAndExtractText(ctx, p.StorageURL, p.MimeType)
+			if extractErr != nil {
+				log.Printf("Text extraction failed for physical file %d: %v", p.ID, extractErr)
+			}
+		}
+		if _, err := pool.Exec(ctx, `UPDATE physical_files SET content_text = NULLIF($2, ''), content_tsv = CASE WHEN $2 = '' THEN NULL ELSE to_tsvector('english', $2) END, text_status = $3 WHERE id = $1`, p.ID, text, textStatusFor(p.MimeType, extractErr)); err != nil {
+			log.Printf("Failed to record extracted text for physical file %d: %v", p.ID, err)
+		}
+	}
+}
+
+func fetchAndExtractText(ctx context.Context, storageURL, mimeType string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, storageURL, nil)
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, "Database error")
-		return
+		return "", fmt.Errorf("could not build storage request: %w", err)
 	}
-	defer tx.Rollback(ctx)
-	var ownerID int
-	var isShared bool
-	var storageURL, filename string
-	query := `SELECT uf.owner_id, pf.storage_url, uf.filename, EXISTS (SELECT 1 FROM file_shares WHERE user_file_id = $1 AND recipient_id = $2) FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = $1`
-	err = tx.QueryRow(ctx, query, userFileID, user.ID).Scan(&ownerID, &storageURL, &filename, &isShared)
+	resp, err := http.DefaultClient.Do(req)
 	if err != nil {
-		if err == pgx.ErrNoRows {
-			writeError(w, http.StatusNotFound, "File not found")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, "Database error on scan")
-		return
+		return "", fmt.Errorf("could not fetch file from storage: %w", err)
 	}
-	if ownerID != user.ID && !isShared && user.Role != "admin" {
-		writeError(w, http.StatusForbidden, "You do not have permission to download this file")
-		return
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("storage returned status %d", resp.StatusCode)
 	}
-	_, err = tx.Exec(ctx, "UPDATE user_files SET download_count = download_count + 1 WHERE id = $1", userFileID)
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxIndexSourceBytes+1))
 	if err != nil {
-		log.Printf("Failed to increment download count for file %d: %v", userFileID, err)
+		return "", fmt.Errorf("could not read file from storage: %w", err)
 	}
-	if err := tx.Commit(ctx); err != nil {
-		writeError(w, http.StatusInternalServerError, "Database error on commit")
-		return
+	if len(data) > maxIndexSourceBytes {
+		return "", fmt.Errorf("file exceeds the %d byte indexing limit", maxIndexSourceBytes)
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_DOWNLOAD_AUTH", map[string]interface{}{"filename": filename})
-	http.Redirect(w, r, storageURL, http.StatusFound)
+	return extractDocumentText(ctx, bytes.NewReader(data), int64(len(data)), mimeType)
 }
 
-func shareWithUserHandler(w http.ResponseWriter, r *http.Request) {
+func startTextIndexWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			indexPendingText(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func startRenditionWorker(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(30 * time.Second)
+		defer ticker.Stop()
+		for {
+			processPendingRenditions(ctx)
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func renditionBlobs(ctx context.Context, tx pgx.Tx, physicalFileID int) []uploadedBlob {
+	rows, err := tx.Query(ctx, `SELECT fr.public_id FROM file_renditions fr JOIN physical_files pf ON fr.physical_hash = pf.hash WHERE pf.id = $1`, physicalFileID)
+	if err != nil {
+		log.Printf("Failed to look up renditions for physical file %d: %v", physicalFileID, err)
+		return nil
+	}
+	defer rows.Close()
+	var blobs []uploadedBlob
+	for rows.Next() {
+		var publicID string
+		if err := rows.Scan(&publicID); err == nil {
+			blobs = append(blobs, uploadedBlob{PublicID: publicID, ResourceType: "image"})
+		}
+	}
+	return blobs
+}
+
+func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userContextKey).(*AuthenticatedUser)
 	vars := mux.Vars(r)
@@ -835,49 +5248,54 @@ func shareWithUserHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "Invalid file ID")
 		return
 	}
-	var req struct {
-		ShareWithUsername string `json:"shareWithUsername"`
+	size := r.URL.Query().Get("size")
+	if size == "" {
+		size = "medium"
 	}
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+	validSize := false
+	for _, s := range renditionSizes {
+		if s.Name == size {
+			validSize = true
+		}
+	}
+	if !validSize {
+		writeError(w, http.StatusBadRequest, "Invalid size. Use small, medium, or large")
 		return
 	}
-	var recipientID int
-	err = pool.QueryRow(ctx, "SELECT id FROM users WHERE username = $1", req.ShareWithUsername).Scan(&recipientID)
+	var ownerID int
+	var permission *string
+	var scanStatus, renditionStatus string
+	var renditionURL *string
+	query := `SELECT uf.owner_id, pf.scan_status, pf.rendition_status, (SELECT fr.storage_url FROM file_renditions fr WHERE fr.physical_hash = pf.hash AND fr.size = $3), ` + sharePermissionExpr("$1", "$2") + ` FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id WHERE uf.id = $1`
+	err = pool.QueryRow(ctx, query, userFileID, user.ID, size).Scan(&ownerID, &scanStatus, &renditionStatus, &renditionURL, &permission)
 	if err != nil {
 		if err == pgx.ErrNoRows {
-			writeError(w, http.StatusNotFound, "User to share with not found")
+			writeError(w, http.StatusNotFound, "File not found")
 			return
 		}
-		writeError(w, http.StatusInternalServerError, "Database error")
+		writeError(w, http.StatusInternalServerError, "Database error on scan")
 		return
 	}
-	if user.ID == recipientID {
-		writeError(w, http.StatusBadRequest, "You cannot share a file with yourself")
+	if !canAccessFile(user, ownerID, permission, sharePermissionViewer) {
+		writeError(w, http.StatusForbidden, "You do not have permission to view this file")
 		return
 	}
-	var ownerID int
-	var filename string
-	err = pool.QueryRow(ctx, "SELECT owner_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &filename)
-	if err != nil {
-		writeError(w, http.StatusNotFound, "File not found")
+	if status, message, blocked := scanBlocksDownload(scanStatus); blocked {
+		writeError(w, status, message)
 		return
 	}
-	if ownerID != user.ID {
-		writeError(w, http.StatusForbidden, "You are not the owner of this file")
+	if renditionURL != nil {
+		http.Redirect(w, r, *renditionURL, http.StatusFound)
 		return
 	}
-	_, err = pool.Exec(ctx, `INSERT INTO file_shares (user_file_id, recipient_id) VALUES ($1, $2)`, userFileID, recipientID)
-	if err != nil {
-		if strings.Contains(err.Error(), "23505") {
-			writeJSON(w, http.StatusConflict, map[string]string{"message": "File already shared with this user"})
-			return
-		}
-		writeError(w, http.StatusInternalServerError, "Failed to share file")
-		return
+	switch renditionStatus {
+	case renditionStatusPending:
+		writeJSON(w, http.StatusAccepted, map[string]string{"status": renditionStatusPending, "message": "Thumbnail is being generated"})
+	case renditionStatusUnsupported:
+		writeError(w, http.StatusNotFound, "No thumbnail is available for this file type")
+	default:
+		writeError(w, http.StatusNotFound, "Thumbnail generation failed for this file")
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_SHARE_USER", map[string]interface{}{"filename": filename, "recipientUsername": req.ShareWithUsername})
-	writeJSON(w, http.StatusCreated, map[string]string{"message": fmt.Sprintf("File successfully shared with %s", req.ShareWithUsername)})
 }
 
 func analyticsHandler(w http.ResponseWriter, r *http.Request) {
@@ -1026,9 +5444,23 @@ func analyticsHandler(w http.ResponseWriter, r *http.Request) {
 
 func adminListAllFilesHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	params := pageParamsFromQuery(r)
+	if err := params.normalize(fileSortColumns, "uploadedAt", false); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageCondition, orderBy, limitClause, pageArgs, err := params.keysetClause(fileSortColumns, "uf.id", 1, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 	baseQuery := `SELECT uf.id, uf.filename, pf.size, pf.mime_type, uf.is_public, uf.download_count, uf.uploaded_at, pf.storage_url, u_owner.name AS owner_name FROM user_files uf JOIN physical_files pf ON uf.physical_file_id = pf.id JOIN users u_owner ON uf.owner_id = u_owner.id`
-	finalQuery := baseQuery + ` ORDER BY uf.uploaded_at DESC`
-	rows, err := pool.Query(ctx, finalQuery)
+	finalQuery := baseQuery
+	if pageCondition != "" {
+		finalQuery += " WHERE " + pageCondition
+	}
+	finalQuery += ` ORDER BY ` + orderBy + limitClause
+	rows, err := pool.Query(ctx, finalQuery, pageArgs...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to query all files: "+err.Error())
 		return
@@ -1054,7 +5486,17 @@ func adminListAllFilesHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		files = append(files, f)
 	}
-	writeJSON(w, http.StatusOK, files)
+	page := PageResponse{Items: []AdminFileInfo{}, Limit: params.Limit}
+	if params.hasMoreRows(len(files)) {
+		files = files[:params.Limit]
+		last := files[len(files)-1]
+		page.HasMore = true
+		page.NextCursor = params.nextCursor(fileCursorValue(params.SortBy, last.Filename, last.Size, last.UploadedAt, last.DownloadCount), int64(last.ID), nil)
+	}
+	if files != nil {
+		page.Items = files
+	}
+	writePage(w, params, page)
 }
 
 type AuditLogEntry struct {
@@ -1065,11 +5507,91 @@ type AuditLogEntry struct {
 	CreatedAt time.Time       `json:"createdAt"`
 }
 
+func adminGetMimePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	mimePolicyMu.RLock()
+	rules := mimePolicyRules
+	mimePolicyMu.RUnlock()
+	if rules == nil {
+		rules = []MimePolicyRule{}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"rules": rules})
+}
+
+func adminUpdateMimePolicyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	user := ctx.Value(userContextKey).(*AuthenticatedUser)
+	var req struct {
+		Rules []MimePolicyRule `json:"rules"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "Invalid JSON body")
+		return
+	}
+	for i, rule := range req.Rules {
+		if rule.Action != "allow" && rule.Action != "deny" {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Rule %d: action must be 'allow' or 'deny'", i))
+			return
+		}
+		if rule.MimePattern != "*" && !strings.Contains(rule.MimePattern, "/") {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Rule %d: invalid mimePattern %q", i, rule.MimePattern))
+			return
+		}
+		if rule.MaxSize != nil && *rule.MaxSize < 0 {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("Rule %d: maxSize must not be negative", i))
+			return
+		}
+	}
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
+		return
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, "DELETE FROM mime_policy_rules"); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to clear mime policy")
+		return
+	}
+	for _, rule := range req.Rules {
+		roles := rule.Roles
+		if roles == nil {
+			roles = []string{}
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO mime_policy_rules (mime_pattern, roles, action, max_size) VALUES ($1, $2, $3, $4)`, strings.ToLower(strings.TrimSpace(rule.MimePattern)), roles, rule.Action, rule.MaxSize); err != nil {
+			writeError(w, http.StatusInternalServerError, "Failed to save mime policy rule")
+			return
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	if err := loadMimePolicy(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Policy saved but failed to reload: "+err.Error())
+		return
+	}
+	logAuditEvent(ctx, user.ID, 0, "MIME_POLICY_UPDATE", map[string]interface{}{"ruleCount": len(req.Rules)})
+	adminGetMimePolicyHandler(w, r)
+}
+
 func getUserAuditLogsHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	user := ctx.Value(userContextKey).(*AuthenticatedUser)
-	query := `SELECT id, action, target_id, details, created_at FROM audit_logs WHERE user_id = $1 ORDER BY created_at DESC`
-	rows, err := pool.Query(ctx, query, user.ID)
+	params := pageParamsFromQuery(r)
+	if err := params.normalize(auditLogSortColumns, "createdAt", false); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	pageCondition, orderBy, limitClause, pageArgs, err := params.keysetClause(auditLogSortColumns, "id", 2, nil)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	query := `SELECT id, action, target_id, details, created_at FROM audit_logs WHERE user_id = $1`
+	if pageCondition != "" {
+		query += " AND " + pageCondition
+	}
+	query += ` ORDER BY ` + orderBy + limitClause
+	rows, err := pool.Query(ctx, query, append([]interface{}{user.ID}, pageArgs...)...)
 	if err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to query audit logs: "+err.Error())
 		return
@@ -1084,7 +5606,17 @@ func getUserAuditLogsHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		logs = append(logs, logEntry)
 	}
-	writeJSON(w, http.StatusOK, logs)
+	page := PageResponse{Items: []AuditLogEntry{}, Limit: params.Limit}
+	if params.hasMoreRows(len(logs)) {
+		logs = logs[:params.Limit]
+		last := logs[len(logs)-1]
+		page.HasMore = true
+		page.NextCursor = params.nextCursor(last.CreatedAt.Format(time.RFC3339Nano), last.ID, nil)
+	}
+	if logs != nil {
+		page.Items = logs
+	}
+	writePage(w, params, page)
 }
 
 func makeFilePrivateHandler(w http.ResponseWriter, r *http.Request) {
@@ -1096,27 +5628,30 @@ func makeFilePrivateHandler(w http.ResponseWriter, r *http.Request) {
 		writeError(w, http.StatusBadRequest, "Invalid file ID")
 		return
 	}
-	var ownerID int
-	var filename string
-	err = pool.QueryRow(ctx, "SELECT owner_id, filename FROM user_files WHERE id = $1", userFileID).Scan(&ownerID, &filename)
-	if err != nil {
-		if err == pgx.ErrNoRows {
-			writeError(w, http.StatusNotFound, "File not found")
-			return
-		}
-		writeError(w, http.StatusInternalServerError, "Database error")
+	filename, ok := shareableFilename(ctx, w, userFileID, user)
+	if !ok {
 		return
 	}
-	if ownerID != user.ID {
-		writeError(w, http.StatusForbidden, "You are not the owner of this file")
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Could not start transaction")
 		return
 	}
-	_, err = pool.Exec(ctx, "UPDATE user_files SET is_public = false WHERE id = $1", userFileID)
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, "UPDATE public_links SET revoked_at = NOW() WHERE user_file_id = $1 AND revoked_at IS NULL", userFileID)
 	if err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to revoke public links")
+		return
+	}
+	if _, err := tx.Exec(ctx, "UPDATE user_files SET is_public = false WHERE id = $1", userFileID); err != nil {
 		writeError(w, http.StatusInternalServerError, "Failed to make file private")
 		return
 	}
-	logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_PUBLIC", map[string]interface{}{"filename": filename})
+	if err := tx.Commit(ctx); err != nil {
+		writeError(w, http.StatusInternalServerError, "Failed to commit transaction")
+		return
+	}
+	logAuditEvent(ctx, user.ID, userFileID, "FILE_UNSHARE_PUBLIC", map[string]interface{}{"filename": filename, "revokedLinks": tag.RowsAffected()})
 	writeJSON(w, http.StatusOK, map[string]string{"message": "File is now private"})
 }
 
@@ -1125,6 +5660,7 @@ func main() {
 	initDB()
 	initCloudinary()
 	initMimeTypes()
+	initScanner()
 	defer pool.Close()
 	// Create a context for initialization that can be cancelled.
 	initCtx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
@@ -1132,32 +5668,89 @@ func main() {
 	if err := ensureFilesSchema(initCtx); err != nil {
 		log.Fatal("Failed to ensure schemas: ", err)
 	}
+	if err := loadMimePolicy(initCtx); err != nil {
+		log.Fatal("Failed to load mime policy: ", err)
+	}
+	workerCtx, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+	startScanWorker(workerCtx)
+	startRenditionWorker(workerCtx)
+	startTextIndexWorker(workerCtx)
+	startExpiryWorker(workerCtx)
 
 	r := mux.NewRouter()
 	authRouter := r.PathPrefix("/auth").Subrouter()
 	authRouter.HandleFunc("/signup", signupHandler).Methods("POST")
 	authRouter.HandleFunc("/login", loginHandler).Methods("POST")
 	r.HandleFunc("/health", healthHandler).Methods("GET")
-	r.HandleFunc("/files/public/{id:[0-9]+}", publicDownloadHandler).Methods("GET")
+	r.HandleFunc("/files/public/{token:[A-Za-z0-9_-]{43}}", publicDownloadHandler).Methods("GET")
+	r.HandleFunc("/files/public/{token:[A-Za-z0-9_-]{43}}/unlock", unlockPublicLinkHandler).Methods("POST")
+	r.HandleFunc("/files/public/{id:[0-9]+}", legacyPublicDownloadHandler).Methods("GET")
+	r.HandleFunc("/files/download/{signature:[A-Za-z0-9_-]+\\.[A-Za-z0-9_-]+}", signedDownloadHandler).Methods("GET")
 	api := r.PathPrefix("/api").Subrouter()
 	api.Use(authMiddleware)
 	api.Use(rateLimitMiddleware)
 	api.HandleFunc("/files/upload", uploadHandler).Methods("POST")
 	api.HandleFunc("/files/search", searchFilesHandler).Methods("POST")
+	api.HandleFunc("/files/archive", archiveDownloadHandler).Methods("POST")
+	api.HandleFunc("/files/duplicates", listDuplicatesHandler).Methods("GET")
+	api.HandleFunc("/files/duplicates/collapse", collapseDuplicatesHandler).Methods("POST")
 	api.HandleFunc("/files/analytics", analyticsHandler).Methods("POST")
 	api.HandleFunc("/files/{id:[0-9]+}", deleteFileHandler).Methods("DELETE")
+	api.HandleFunc("/files/{id:[0-9]+}", renameFileHandler).Methods("PATCH")
 	api.HandleFunc("/files/{id:[0-9]+}/share-public", shareFileHandler).Methods("POST")
 	api.HandleFunc("/files/{id:[0-9]+}/share-with", shareWithUserHandler).Methods("POST")
+	api.HandleFunc("/files/{id:[0-9]+}/shares", revokeAllSharesHandler).Methods("DELETE")
+	api.HandleFunc("/files/{id:[0-9]+}/share-group", shareWithGroupHandler).Methods("POST")
+	api.HandleFunc("/files/{id:[0-9]+}/groups/{groupId:[0-9]+}", unshareGroupHandler).Methods("DELETE")
+	api.HandleFunc("/files/{id:[0-9]+}/shares/{recipientId:[0-9]+}", updateSharePermissionHandler).Methods("PUT")
+	api.HandleFunc("/files/{id:[0-9]+}/shares/{recipientId:[0-9]+}", revokeShareHandler).Methods("DELETE")
 	api.HandleFunc("/files/{id:[0-9]+}/share-public", makeFilePrivateHandler).Methods("DELETE")
+	api.HandleFunc("/files/{id:[0-9]+}/public-links", listPublicLinksHandler).Methods("GET")
+	api.HandleFunc("/files/{id:[0-9]+}/public-links", createPublicLinkHandler).Methods("POST")
+	api.HandleFunc("/files/{id:[0-9]+}/public-links/{linkId:[0-9]+}", revokePublicLinkHandler).Methods("DELETE")
+	api.HandleFunc("/files/{id:[0-9]+}/public-links/{linkId:[0-9]+}/password", setPublicLinkPasswordHandler).Methods("PUT")
 	api.HandleFunc("/files/{id:[0-9]+}/share", unshareFileHandler).Methods("DELETE")
 	api.HandleFunc("/files/{id:[0-9]+}/download", authenticatedDownloadHandler).Methods("GET")
+	api.HandleFunc("/files/{id:[0-9]+}/download-url", createSignedDownloadURLHandler).Methods("POST")
+	api.HandleFunc("/files/{id:[0-9]+}/thumbnail", thumbnailHandler).Methods("GET")
+	api.HandleFunc("/files/{id:[0-9]+}/same-content", sameContentHandler).Methods("GET")
+	api.HandleFunc("/files/{id:[0-9]+}/access-requests", createAccessRequestHandler).Methods("POST")
+	api.HandleFunc("/access-requests", listAccessRequestsHandler).Methods("GET")
+	api.HandleFunc("/access-requests/{requestId:[0-9]+}/approve", approveAccessRequestHandler).Methods("POST")
+	api.HandleFunc("/access-requests/{requestId:[0-9]+}/deny", denyAccessRequestHandler).Methods("POST")
 	api.HandleFunc("/files/shared-by-me", listMySharedFilesHandler).Methods("GET")
 	api.HandleFunc("/logs", getUserAuditLogsHandler).Methods("GET")
+	api.HandleFunc("/share-invitations", listShareInvitationsHandler).Methods("GET")
+	api.HandleFunc("/share-invitations/{invitationId:[0-9]+}/accept", respondShareInvitationHandler(true)).Methods("POST")
+	api.HandleFunc("/share-invitations/{invitationId:[0-9]+}/decline", respondShareInvitationHandler(false)).Methods("POST")
+	api.HandleFunc("/share-preferences", getSharePreferencesHandler).Methods("GET")
+	api.HandleFunc("/share-preferences", updateSharePreferencesHandler).Methods("PUT")
+	api.HandleFunc("/share-preferences/trusted-senders/{userId:[0-9]+}", removeTrustedSenderHandler).Methods("DELETE")
+	api.HandleFunc("/groups", listGroupsHandler).Methods("GET")
+	api.HandleFunc("/group-invitations", listGroupInvitationsHandler).Methods("GET")
+	api.HandleFunc("/group-invitations/{groupId:[0-9]+}/accept", respondGroupInvitationHandler(true)).Methods("POST")
+	api.HandleFunc("/group-invitations/{groupId:[0-9]+}/decline", respondGroupInvitationHandler(false)).Methods("POST")
+	api.HandleFunc("/groups", createGroupHandler).Methods("POST")
+	api.HandleFunc("/groups/{groupId:[0-9]+}", getGroupHandler).Methods("GET")
+	api.HandleFunc("/groups/{groupId:[0-9]+}", renameGroupHandler).Methods("PUT")
+	api.HandleFunc("/groups/{groupId:[0-9]+}", deleteGroupHandler).Methods("DELETE")
+	api.HandleFunc("/groups/{groupId:[0-9]+}/members", addGroupMemberHandler).Methods("POST")
+	api.HandleFunc("/groups/{groupId:[0-9]+}/members/{userId:[0-9]+}", updateGroupMemberHandler).Methods("PUT")
+	api.HandleFunc("/groups/{groupId:[0-9]+}/members/{userId:[0-9]+}", removeGroupMemberHandler).Methods("DELETE")
+	api.HandleFunc("/collections", listSavedSearchesHandler).Methods("GET")
+	api.HandleFunc("/collections", createSavedSearchHandler).Methods("POST")
+	api.HandleFunc("/collections/order", reorderSavedSearchesHandler).Methods("PUT")
+	api.HandleFunc("/collections/{id:[0-9]+}", updateSavedSearchHandler).Methods("PUT")
+	api.HandleFunc("/collections/{id:[0-9]+}", deleteSavedSearchHandler).Methods("DELETE")
+	api.HandleFunc("/collections/{id:[0-9]+}/files", runSavedSearchHandler).Methods("GET")
 	adminAPI := api.PathPrefix("/admin").Subrouter()
 	adminAPI.Use(adminOnlyMiddleware)
 	adminAPI.HandleFunc("/files/all", adminListAllFilesHandler).Methods("POST")
+	adminAPI.HandleFunc("/mime-policy", adminGetMimePolicyHandler).Methods("GET")
+	adminAPI.HandleFunc("/mime-policy", adminUpdateMimePolicyHandler).Methods("PUT")
 
-	corsHandler := handlers.CORS(handlers.AllowedOrigins([]string{"http://localhost:5173","http://localhost:8080", "https://keyvia.vercel.app", "https://keyvia-backend.onrender.com"}), handlers.AllowedMethods([]string{"GET", "POST", "DELETE", "OPTIONS"}), handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}))(r)
+	corsHandler := handlers.CORS(handlers.AllowedOrigins([]string{"http://localhost:5173","http://localhost:8080", "https://keyvia.vercel.app", "https://keyvia-backend.onrender.com"}), handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}), handlers.AllowedHeaders([]string{"Content-Type", "Authorization"}))(r)
 
 	server := &http.Server{
 		Addr:    ":8080",
@@ -1179,4 +5772,4 @@ func main() {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 	log.Println("Server exited properly")
-}
\ No newline at end of file
+}
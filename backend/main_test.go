@@ -0,0 +1,441 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeClamd speaks enough of the clamd INSTREAM protocol to answer one scan,
+// reporting payloads containing "EICAR" as infected.
+func fakeClamd(t *testing.T) (string, <-chan []byte) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	received := make(chan []byte, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		reader := bufio.NewReader(conn)
+		command, err := reader.ReadString(0)
+		if err != nil || command != "zINSTREAM\x00" {
+			conn.Write([]byte("UNKNOWN COMMAND\x00"))
+			return
+		}
+		var payload bytes.Buffer
+		size := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(reader, size); err != nil {
+				return
+			}
+			n := binary.BigEndian.Uint32(size)
+			if n == 0 {
+				break
+			}
+			if _, err := io.CopyN(&payload, reader, int64(n)); err != nil {
+				return
+			}
+		}
+		received <- payload.Bytes()
+		if bytes.Contains(payload.Bytes(), []byte("EICAR")) {
+			conn.Write([]byte("stream: Eicar-Test-Signature FOUND\x00"))
+			return
+		}
+		conn.Write([]byte("stream: OK\x00"))
+	}()
+	return ln.Addr().String(), received
+}
+
+func TestClamdScannerClean(t *testing.T) {
+	addr, received := fakeClamd(t)
+	content := strings.Repeat("harmless content ", 5000)
+	verdict, err := clamdScanner{Address: addr, Timeout: 5 * time.Second}.Scan(context.Background(), strings.NewReader(content))
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	if !verdict.Clean || verdict.Signature != "" {
+		t.Fatalf("expected clean verdict, got %+v", verdict)
+	}
+	if got := <-received; string(got) != content {
+		t.Fatalf("clamd received %d bytes, want %d", len(got), len(content))
+	}
+}
+
+func TestClamdScannerInfected(t *testing.T) {
+	addr, _ := fakeClamd(t)
+	verdict, err := clamdScanner{Address: addr, Timeout: 5 * time.Second}.Scan(context.Background(), strings.NewReader("X5O!P%@AP EICAR test file"))
+	if err != nil {
+		t.Fatalf("Scan returned error: %v", err)
+	}
+	if verdict.Clean || verdict.Signature != "Eicar-Test-Signature" {
+		t.Fatalf("expected infected verdict with signature, got %+v", verdict)
+	}
+}
+
+func TestClamdScannerUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	if _, err := (clamdScanner{Address: addr, Timeout: time.Second}).Scan(context.Background(), strings.NewReader("data")); err == nil {
+		t.Fatal("expected an error when clamd is unreachable")
+	}
+}
+
+func TestTokenizeSearchQuery(t *testing.T) {
+	tests := []struct {
+		q       string
+		want    []queryToken
+		wantPos int
+	}{
+		{q: `report "q3 plan" type:pdf`, want: []queryToken{{`report`, 0}, {`"q3 plan"`, 7}, {`type:pdf`, 17}}},
+		{q: `  name:"a b"  `, want: []queryToken{{`name:"a b"`, 2}}},
+		{q: `über size>1`, want: []queryToken{{`über`, 0}, {`size>1`, 5}}},
+		{q: `foo "bar`, wantPos: 4},
+		{q: `a name:"x y`, wantPos: 7},
+	}
+	for _, tt := range tests {
+		got, err := tokenizeSearchQuery(tt.q)
+		if tt.want == nil {
+			var syntaxErr *QuerySyntaxError
+			if !errors.As(err, &syntaxErr) {
+				t.Errorf("tokenizeSearchQuery(%q) error = %v, want a QuerySyntaxError", tt.q, err)
+				continue
+			}
+			if syntaxErr.Position != tt.wantPos || syntaxErr.Message != "unterminated quote" {
+				t.Errorf("tokenizeSearchQuery(%q) error at %d (%s), want unterminated quote at %d", tt.q, syntaxErr.Position, syntaxErr.Message, tt.wantPos)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("tokenizeSearchQuery(%q) returned error: %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tokenizeSearchQuery(%q) = %v, want %v", tt.q, got, tt.want)
+		}
+	}
+}
+
+func TestCompileSearchQuery(t *testing.T) {
+	tests := []struct {
+		q         string
+		argID     int
+		wantConds []string
+		wantArgs  []interface{}
+		wantNext  int
+	}{
+		{q: "report", argID: 2, wantConds: []string{`uf.filename ILIKE $2 ESCAPE '\'`}, wantArgs: []interface{}{"%report%"}, wantNext: 3},
+		{q: `"q3 plan"`, argID: 2, wantConds: []string{`uf.filename ILIKE $2 ESCAPE '\'`}, wantArgs: []interface{}{"%q3 plan%"}, wantNext: 3},
+		{q: "name:100%", argID: 5, wantConds: []string{`uf.filename ILIKE $5 ESCAPE '\'`}, wantArgs: []interface{}{`%100\%%`}, wantNext: 6},
+		{q: `name:a_b\c`, argID: 2, wantConds: []string{`uf.filename ILIKE $2 ESCAPE '\'`}, wantArgs: []interface{}{`%a\_b\\c%`}, wantNext: 3},
+		{q: "size>=10MB", argID: 3, wantConds: []string{"pf.size >= $3"}, wantArgs: []interface{}{int64(10 << 20)}, wantNext: 4},
+		{q: "size:1.5kb", argID: 2, wantConds: []string{"pf.size = $2"}, wantArgs: []interface{}{int64(1536)}, wantNext: 3},
+		{
+			q: "type:pdf,image/*", argID: 4,
+			wantConds: []string{"(uf.filename ILIKE $4 ESCAPE '\\' OR " + baseMIMEExpr + " = $5 OR " + baseMIMEExpr + " LIKE $6)"},
+			wantArgs:  []interface{}{"%.pdf", "application/pdf", "image/%"},
+			wantNext:  7,
+		},
+		{q: "owner:me shared:no", argID: 2, wantConds: []string{"uf.owner_id = $1", "uf.owner_id = $1"}, wantNext: 2},
+		{q: "after:2024-01-31", argID: 2, wantConds: []string{"uf.uploaded_at >= $2"}, wantArgs: []interface{}{time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)}, wantNext: 3},
+	}
+	for _, tt := range tests {
+		conds, args, next, err := compileSearchQuery(tt.q, tt.argID)
+		if err != nil {
+			t.Errorf("compileSearchQuery(%q) returned error: %v", tt.q, err)
+			continue
+		}
+		if !reflect.DeepEqual(conds, tt.wantConds) || !reflect.DeepEqual(args, tt.wantArgs) || next != tt.wantNext {
+			t.Errorf("compileSearchQuery(%q, %d) = %q, %v, %d; want %q, %v, %d", tt.q, tt.argID, conds, args, next, tt.wantConds, tt.wantArgs, tt.wantNext)
+		}
+	}
+}
+
+func TestCompileSearchQueryRelativeDate(t *testing.T) {
+	conds, args, next, err := compileSearchQuery("before:-7d", 3)
+	if err != nil {
+		t.Fatalf("compileSearchQuery returned error: %v", err)
+	}
+	if !reflect.DeepEqual(conds, []string{"uf.uploaded_at < $3"}) || next != 4 || len(args) != 1 {
+		t.Fatalf("unexpected compilation: %q %v %d", conds, args, next)
+	}
+	at, ok := args[0].(time.Time)
+	if want := time.Now().AddDate(0, 0, -7); !ok || at.Sub(want).Abs() > time.Minute {
+		t.Fatalf("before:-7d resolved to %v, want about %v", args[0], want)
+	}
+}
+
+func TestCompileSearchQueryErrors(t *testing.T) {
+	tests := []struct {
+		q       string
+		wantPos int
+		wantMsg string
+	}{
+		{q: "colour:red", wantPos: 0, wantMsg: `unknown field "colour"`},
+		{q: "report size>big", wantPos: 7, wantMsg: "invalid size"},
+		{q: "name>foo", wantPos: 0, wantMsg: "name only supports ':'"},
+		{q: "type:pdf,,doc", wantPos: 0, wantMsg: "empty type in list"},
+		{q: "a shared:maybe", wantPos: 2, wantMsg: "shared expects yes or no"},
+		{q: "before:yesterday", wantPos: 0, wantMsg: "invalid date"},
+		{q: "owner:", wantPos: 0, wantMsg: "missing value for owner"},
+		{q: `x "open`, wantPos: 2, wantMsg: "unterminated quote"},
+	}
+	for _, tt := range tests {
+		_, _, _, err := compileSearchQuery(tt.q, 2)
+		var syntaxErr *QuerySyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("compileSearchQuery(%q) error = %v, want a QuerySyntaxError", tt.q, err)
+			continue
+		}
+		if syntaxErr.Position != tt.wantPos || !strings.Contains(syntaxErr.Message, tt.wantMsg) {
+			t.Errorf("compileSearchQuery(%q) error at %d (%s), want %q at %d", tt.q, syntaxErr.Position, syntaxErr.Message, tt.wantMsg, tt.wantPos)
+		}
+	}
+}
+
+func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	tests := []struct {
+		raw  string
+		want string
+	}{
+		{raw: "report.pdf", want: "report.pdf"},
+		{raw: "../../etc/passwd", want: "passwd"},
+		{raw: `..\..\windows\boot.ini`, want: "boot.ini"},
+		{raw: "uploads/", want: "unnamed"},
+		{raw: "..", want: "unnamed"},
+		{raw: ".", want: "unnamed"},
+		{raw: "   ", want: "unnamed"},
+		{raw: "  spaced.txt\t", want: "spaced.txt"},
+		{raw: "invoice\u202Efdp.exe", want: "invoicefdp.exe"},
+		{raw: "a\u2066b\u2069\u200Ec.txt", want: "abc.txt"},
+		{raw: "bad\x00na\nme\x7f.txt", want: "badname.txt"},
+		{raw: "a\xffb.txt", want: "ab.txt"},
+		{raw: "cafe\u0301.txt", want: "caf\u00e9.txt"},
+		{raw: long + ".pdf", want: long[:251] + ".pdf"},
+		{raw: strings.Repeat("\u00e9", 300) + ".txt", want: strings.Repeat("\u00e9", 251) + ".txt"},
+		{raw: "a." + long, want: ("a." + long)[:255]},
+	}
+	for _, tt := range tests {
+		if got := sanitizeFilename(tt.raw); got != tt.want {
+			t.Errorf("sanitizeFilename(%q) = %q, want %q", tt.raw, got, tt.want)
+		}
+	}
+}
+
+func TestNumberedFilename(t *testing.T) {
+	tests := []struct {
+		filename string
+		n        int
+		want     string
+	}{
+		{filename: "report.pdf", n: 2, want: "report (2).pdf"},
+		{filename: "notes", n: 3, want: "notes (3)"},
+		{filename: "archive.tar.gz", n: 2, want: "archive.tar (2).gz"},
+		{filename: strings.Repeat("a", 251) + ".pdf", n: 2, want: strings.Repeat("a", 247) + " (2).pdf"},
+		{filename: strings.Repeat("\u00e9", 255), n: 10, want: strings.Repeat("\u00e9", 250) + " (10)"},
+		{filename: "." + strings.Repeat("x", 254), n: 2, want: "." + strings.Repeat("x", 250) + " (2)"},
+		{filename: "a." + strings.Repeat("b", 253), n: 12, want: "a." + strings.Repeat("b", 248) + " (12)"},
+	}
+	for _, tt := range tests {
+		got := numberedFilename(tt.filename, tt.n)
+		if got != tt.want {
+			t.Errorf("numberedFilename(%q, %d) = %q, want %q", tt.filename, tt.n, got, tt.want)
+		}
+		if runes := []rune(got); len(runes) > maxFilenameLength {
+			t.Errorf("numberedFilename(%q, %d) is %d runes, limit is %d", tt.filename, tt.n, len(runes), maxFilenameLength)
+		}
+	}
+}
+
+func withJWTSecret(t *testing.T, secret string) {
+	t.Helper()
+	previous := jwtSecret
+	jwtSecret = []byte(secret)
+	t.Cleanup(func() { jwtSecret = previous })
+}
+
+func TestSignedValueRoundTrip(t *testing.T) {
+	withJWTSecret(t, "test-secret")
+	signed := signValue(signedDownloadPurpose, "42:7:1700000000")
+	payload, ok := verifySignedValue(signedDownloadPurpose, signed)
+	if !ok || payload != "42:7:1700000000" {
+		t.Fatalf("verifySignedValue = %q, %v; want the original payload", payload, ok)
+	}
+}
+
+func TestVerifySignedValueRejectsTampering(t *testing.T) {
+	withJWTSecret(t, "test-secret")
+	signed := signValue(signedDownloadPurpose, "42:7:1700000000")
+	encodedPayload, encodedSig, _ := strings.Cut(signed, ".")
+	forgedPayload := signValue(signedDownloadPurpose, "43:7:1700000000")
+	forgedEncodedPayload, _, _ := strings.Cut(forgedPayload, ".")
+	flipped := []byte(encodedSig)
+	if flipped[0] == 'A' {
+		flipped[0] = 'B'
+	} else {
+		flipped[0] = 'A'
+	}
+	tests := map[string]string{
+		"tampered payload":   forgedEncodedPayload + "." + encodedSig,
+		"tampered signature": encodedPayload + "." + string(flipped),
+		"missing signature":  encodedPayload,
+		"invalid encoding":   encodedPayload + ".!!!",
+		"empty":              "",
+	}
+	for name, value := range tests {
+		if payload, ok := verifySignedValue(signedDownloadPurpose, value); ok {
+			t.Errorf("%s: verifySignedValue accepted %q with payload %q", name, value, payload)
+		}
+	}
+}
+
+func TestVerifySignedValueRejectsOtherPurpose(t *testing.T) {
+	withJWTSecret(t, "test-secret")
+	signed := signValue(publicLinkUnlockPurpose, "42:1700000000:abcd")
+	if _, ok := verifySignedValue(signedDownloadPurpose, signed); ok {
+		t.Fatal("a value signed for unlocking a link was accepted as a signed download")
+	}
+	withJWTSecret(t, "rotated-secret")
+	if _, ok := verifySignedValue(publicLinkUnlockPurpose, signed); ok {
+		t.Fatal("a value signed with the old secret was accepted after rotation")
+	}
+}
+
+func TestLinkUnlockTokenValid(t *testing.T) {
+	withJWTSecret(t, "test-secret")
+	hash := "$2a$10$examplehashvalue"
+	valid := issueLinkUnlockToken(5, hash, time.Now().Add(publicLinkUnlockTTL))
+	if !linkUnlockTokenValid(valid, 5, hash) {
+		t.Fatal("a fresh unlock token was rejected")
+	}
+	if linkUnlockTokenValid(valid, 6, hash) {
+		t.Error("an unlock token was accepted for a different link")
+	}
+	if linkUnlockTokenValid(valid, 5, "$2a$10$changedpassword") {
+		t.Error("an unlock token survived a password change")
+	}
+	expired := issueLinkUnlockToken(5, hash, time.Now().Add(-time.Second))
+	if linkUnlockTokenValid(expired, 5, hash) {
+		t.Error("an expired unlock token was accepted")
+	}
+}
+
+func TestPageParamsNormalize(t *testing.T) {
+	tests := []struct {
+		name        string
+		params      PageParams
+		allowRank   bool
+		wantLimit   int
+		wantSort    string
+		wantDir     string
+		wantUnpaged bool
+		wantErr     bool
+	}{
+		{name: "defaults", params: PageParams{}, wantLimit: defaultPageLimit, wantSort: "uploadedAt", wantDir: "desc", wantUnpaged: true},
+		{name: "clamped limit", params: PageParams{Limit: 5000, SortBy: "name", SortDir: "ASC"}, wantLimit: maxPageLimit, wantSort: "name", wantDir: "asc"},
+		{name: "cursor without limit", params: PageParams{Cursor: "x"}, wantLimit: defaultPageLimit, wantSort: "uploadedAt", wantDir: "desc"},
+		{name: "unknown sort column", params: PageParams{Limit: 10, SortBy: "owner"}, wantErr: true},
+		{name: "relevance not allowed", params: PageParams{Limit: 10, SortBy: sortByRelevance}, wantErr: true},
+		{name: "relevance allowed", params: PageParams{Limit: 10, SortBy: sortByRelevance}, allowRank: true, wantLimit: 10, wantSort: sortByRelevance, wantDir: "desc"},
+		{name: "invalid direction", params: PageParams{Limit: 10, SortDir: "sideways"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		p := tt.params
+		err := p.normalize(fileSortColumns, "uploadedAt", tt.allowRank)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %+v", tt.name, p)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if p.Limit != tt.wantLimit || p.SortBy != tt.wantSort || p.SortDir != tt.wantDir || p.unpaged != tt.wantUnpaged {
+			t.Errorf("%s: got limit=%d sort=%s dir=%s unpaged=%v", tt.name, p.Limit, p.SortBy, p.SortDir, p.unpaged)
+		}
+	}
+}
+
+func TestKeysetClauseRejectsBadCursors(t *testing.T) {
+	nameAsc := PageParams{Limit: 10, SortBy: "name", SortDir: "asc"}
+	tests := map[string]string{
+		"not base64":         "%%%",
+		"not json":           base64.RawURLEncoding.EncodeToString([]byte("nope")),
+		"different sort":     encodeCursor(pageCursor{SortBy: "size", SortDir: "asc", Value: "1", ID: 1}),
+		"different order":    encodeCursor(pageCursor{SortBy: "name", SortDir: "desc", Value: "a", ID: 1}),
+		"relevance mismatch": encodeCursor(pageCursor{SortBy: sortByRelevance, SortDir: "desc", ID: 1}),
+	}
+	for name, cursor := range tests {
+		p := nameAsc
+		p.Cursor = cursor
+		if _, _, _, _, err := p.keysetClause(fileSortColumns, "uf.id", 3, nil); err == nil {
+			t.Errorf("%s: cursor %q was accepted", name, cursor)
+		}
+	}
+	ranked := PageParams{Limit: 10, SortBy: sortByRelevance, SortDir: "desc", Cursor: encodeCursor(pageCursor{SortBy: sortByRelevance, SortDir: "desc", ID: 9, Scores: []float64{0.5}})}
+	if _, _, _, _, err := ranked.keysetClause(fileSortColumns, "uf.id", 3, []string{"rank_expr", "similarity_expr"}); err == nil {
+		t.Error("a relevance cursor with the wrong number of scores was accepted")
+	}
+}
+
+func TestKeysetClause(t *testing.T) {
+	p := PageParams{Limit: 20, SortBy: "name", SortDir: "asc"}
+	condition, orderBy, limit, args, err := p.keysetClause(fileSortColumns, "uf.id", 4, nil)
+	if err != nil || condition != "" || orderBy != "uf.filename asc, uf.id asc" || limit != " LIMIT 21" || args != nil {
+		t.Fatalf("first page = %q, %q, %q, %v, %v", condition, orderBy, limit, args, err)
+	}
+	p.Cursor = p.nextCursor("report.pdf", 17, nil)
+	condition, _, _, args, err = p.keysetClause(fileSortColumns, "uf.id", 4, nil)
+	if err != nil || condition != "(uf.filename, uf.id) > ($4::text, $5)" || !reflect.DeepEqual(args, []interface{}{"report.pdf", int64(17)}) {
+		t.Fatalf("next page = %q, %v, %v", condition, args, err)
+	}
+	unpaged := PageParams{}
+	if err := unpaged.normalize(fileSortColumns, "uploadedAt", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, limit, _, _ := unpaged.keysetClause(fileSortColumns, "uf.id", 2, nil); limit != "" {
+		t.Fatalf("unpaged request got limit clause %q", limit)
+	}
+}
+
+func TestKeysetClauseRelevance(t *testing.T) {
+	p := PageParams{Limit: 10, SortBy: sortByRelevance, SortDir: "desc"}
+	exprs := []string{"rank_expr", "similarity_expr"}
+	condition, orderBy, _, _, err := p.keysetClause(fileSortColumns, "uf.id", 6, exprs)
+	if err != nil || condition != "" || orderBy != "rank_expr DESC, similarity_expr DESC, uf.id DESC" {
+		t.Fatalf("first page = %q, %q, %v", condition, orderBy, err)
+	}
+	rank, similarity := 0.0607927, 0.25
+	p.Cursor = p.nextCursor("", 42, relevanceScores(&rank, &similarity))
+	condition, _, limit, args, err := p.keysetClause(fileSortColumns, "uf.id", 6, exprs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if condition != "(rank_expr, similarity_expr, uf.id) < ($6::float8, $7::float8, $8)" || strings.Contains(limit, "OFFSET") {
+		t.Fatalf("next page = %q %q", condition, limit)
+	}
+	if !reflect.DeepEqual(args, []interface{}{rank, similarity, int64(42)}) {
+		t.Fatalf("next page args = %v, want scores to survive the cursor exactly", args)
+	}
+}
@@ -2,6 +2,7 @@ import { useState } from 'react';
 import { useFiles } from '../context/FileContext';
 import PDFPreview from './PDFPreview'; // Import the new component
 import { useAuth } from '../context/AuthContext';
+import * as api from '../services/api';
 
 const formatBytes = (bytes, decimals = 2) => {
     if (bytes === 0) return '0 Bytes';
@@ -145,10 +146,21 @@ export default function FileCard({ file, onShare, onPreview }) {
                         <button className="action-btn" title="Preview File (coming soon)" disabled={!isPreviewable} onClick={(e) => { e.stopPropagation(); onPreview(); }}>
                             <svg xmlns="http://www.w3.org/2000/svg" width="18" height="18" viewBox="0 0 24 24" fill="none" stroke="currentColor" strokeWidth="2" strokeLinecap="round" strokeLinejoin="round"><path d="M1 12s4-8 11-8 11 8 11 8-4 8-11 8-11-8-11-8z"></path><circle cx="12" cy="12" r="3"></circle></svg>
                         </button>
-                         <button className="action-btn" title="Download File" onClick={(e) => { 
+                         <button className="action-btn" title="Download File" onClick={async (e) => { 
                             e.stopPropagation();
-                            const downloadUrl = `https://keyvia-backend.onrender.com/api/files/${file.id}/download?token=${token}`;
-                            window.open(downloadUrl, '_blank');
+                            // Open the tab synchronously so popup blockers allow it, then point it at the signed URL.
+                            const downloadWindow = window.open('', '_blank');
+                            try {
+                                const { url } = await api.getSignedDownloadUrl(token, file.id);
+                                if (downloadWindow) {
+                                    downloadWindow.location = url;
+                                } else {
+                                    window.location.assign(url);
+                                }
+                            } catch (err) {
+                                if (downloadWindow) downloadWindow.close();
+                                console.error("Failed to start download:", err);
+                            }
                         }}>
                             <svg xmlns="http://www.w3.org/2000/svg" width="18" height="18" viewBox="0 0 24 24" fill="none" stroke="currentColor" strokeWidth="2" strokeLinecap="round" strokeLinejoin="round"><path d="M21 15v4a2 2 0 0 1-2 2H5a2 2 0 0 1-2-2v-4"></path><polyline points="7 10 12 15 17 10"></polyline><line x1="12" y1="15" x2="12" y2="3"></line></svg>
                         </button>
@@ -0,0 +1,13 @@
+export default function LoadMoreButton({ hasMore, loading, onClick }) {
+    if (!hasMore) {
+        return null;
+    }
+
+    return (
+        <div className="load-more">
+            <button className="load-more-btn" onClick={onClick} disabled={loading}>
+                {loading ? 'Loading...' : 'Load more'}
+            </button>
+        </div>
+    );
+}
@@ -21,11 +21,16 @@ export default function ShareModal({ isOpen, onClose, file }) {
   useEffect(() => {
     if (isOpen && file) {
       setIsCurrentlyPublic(file.isPublic);
-      setPublicLink(file.isPublic ? `http://localhost:8080/files/public/${file.id}` : '');
+      setPublicLink('');
+      if (file.isPublic) {
+        api.listPublicLinks(token, file.id)
+          .then(({ links }) => setPublicLink(links.length > 0 ? links[links.length - 1].url : ''))
+          .catch(() => setPublicLink(''));
+      }
       setCopyButtonText('Copy');
       setShareUsername('');
     }
-  }, [isOpen, file]);
+  }, [isOpen, file, token]);
 
   if (!isOpen || !file) {
     return null;
@@ -2,9 +2,10 @@ import { useFiles } from '../../context/FileContext';
 import Loader from '../loader';
 import Placeholder from '../Placeholder';
 import FileCard from '../FileCard';
+import LoadMoreButton from '../LoadMoreButton';
 
 export default function AllFilesView({ openShareModal, openPreviewModal }) {
-    const { files, loading, error } = useFiles();
+    const { files, loading, error, hasMoreFiles, loadingMoreFiles, loadMoreFiles } = useFiles();
 
     if (loading) {
         return <Loader />;
@@ -34,7 +35,7 @@ export default function AllFilesView({ openShareModal, openPreviewModal }) {
                 <FileCard key={file.id} file={file} onShare={() => openShareModal(file)} onPreview={() => openPreviewModal(file)} />
             ))}
         </div>}
-        
+        <LoadMoreButton hasMore={hasMoreFiles} loading={loadingMoreFiles} onClick={loadMoreFiles} />
         </div>
     );
 }
\ No newline at end of file
@@ -1,9 +1,10 @@
 import { useFiles } from '../../context/FileContext';
 import Loader from '../loader';
 import HistoryItem from '../HistoryItem'; 
+import LoadMoreButton from '../LoadMoreButton';
 
 export default function History() {
-  const { history, historyLoading } = useFiles();
+  const { history, historyLoading, hasMoreHistory, loadingMoreHistory, loadMoreHistory } = useFiles();
 
   if (historyLoading) {
     return <Loader />;
@@ -28,6 +29,7 @@ export default function History() {
           <HistoryItem key={log.id} log={log} />
         ))}
       </div>
+      <LoadMoreButton hasMore={hasMoreHistory} loading={loadingMoreHistory} onClick={loadMoreHistory} />
     </div>
   );
 }
\ No newline at end of file
@@ -3,9 +3,10 @@ import { useAuth } from '../../context/AuthContext';
 import Loader from '../loader';
 import Placeholder from '../Placeholder';
 import FileCard from '../FileCard';
+import LoadMoreButton from '../LoadMoreButton';
 
 export default function ReceivedFilesView({ openShareModal, openPreviewModal }) {
-    const { files, loading, error } = useFiles();
+    const { files, loading, error, hasMoreFiles, loadingMoreFiles, loadMoreFiles } = useFiles();
     const { user } = useAuth(); // Not strictly needed for filtering anymore, but maybe for other UI elements
 
     if (loading) {
@@ -23,7 +24,7 @@ export default function ReceivedFilesView({ openShareModal, openPreviewModal })
     
     const receivedFiles = (files)? files.filter(file => file.sharedBy) : "";
 
-    if (receivedFiles && receivedFiles.length === 0) {
+    if (receivedFiles && receivedFiles.length === 0 && !hasMoreFiles) {
         return <Placeholder 
             title="No Received Files"
             message="No files have been shared with you yet."
@@ -31,6 +32,7 @@ export default function ReceivedFilesView({ openShareModal, openPreviewModal })
     }
 
     return (
+        <div className="mainfilediv">
         <div className="filesdiv">
             {!receivedFiles && <Placeholder 
             title="No Received Files"
@@ -40,5 +42,7 @@ export default function ReceivedFilesView({ openShareModal, openPreviewModal })
                 <FileCard key={file.id} file={file} onShare={() => openShareModal(file)} onPreview={() => openPreviewModal(file)} />
             ))}
         </div>
+        <LoadMoreButton hasMore={hasMoreFiles} loading={loadingMoreFiles} onClick={loadMoreFiles} />
+        </div>
     );
 }
\ No newline at end of file
@@ -2,9 +2,10 @@ import { useFiles } from '../../context/FileContext';
 import Loader from '../loader';
 import Placeholder from '../Placeholder';
 import FileCard from '../FileCard';
+import LoadMoreButton from '../LoadMoreButton';
 
 export default function SharedFilesView({ openShareModal, openPreviewModal }) {
-    const { sharedFiles, sharedFilesLoading } = useFiles();
+    const { sharedFiles, sharedFilesLoading, hasMoreSharedFiles, loadingMoreSharedFiles, loadMoreSharedFiles } = useFiles();
 
     if (sharedFilesLoading) {
         return <Loader />;
@@ -18,6 +19,7 @@ export default function SharedFilesView({ openShareModal, openPreviewModal }) {
     }
 
     return (
+        <div className="mainfilediv">
         <div className="filesdiv">
             {!sharedFiles &&
                 <Placeholder 
@@ -29,5 +31,7 @@ export default function SharedFilesView({ openShareModal, openPreviewModal }) {
                 <FileCard key={file.id} file={file} onShare={() => openShareModal(file)} onPreview={() => openPreviewModal(file)} />
             ))}
         </div>
+        <LoadMoreButton hasMore={hasMoreSharedFiles} loading={loadingMoreSharedFiles} onClick={loadMoreSharedFiles} />
+        </div>
     );
 }
\ No newline at end of file
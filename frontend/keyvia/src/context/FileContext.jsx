@@ -14,59 +14,113 @@ export function FileProvider({ children }) {
     const [loading, setLoading] = useState(true);
     const [error, setError] = useState(null);
     const [filters, setFilters] = useState({});
+    const [filesCursor, setFilesCursor] = useState('');
+    const [loadingMoreFiles, setLoadingMoreFiles] = useState(false);
 
     // --- State for "Shared By Me" view ---
     const [sharedFiles, setSharedFiles] = useState([]);
     const [sharedFilesLoading, setSharedFilesLoading] = useState(true);
+    const [sharedFilesCursor, setSharedFilesCursor] = useState('');
+    const [loadingMoreSharedFiles, setLoadingMoreSharedFiles] = useState(false);
 
       const [history, setHistory] = useState([]);
     const [historyLoading, setHistoryLoading] = useState(true);
+    const [historyCursor, setHistoryCursor] = useState('');
+    const [loadingMoreHistory, setLoadingMoreHistory] = useState(false);
 
     const fetchFiles = useCallback(async (currentFilters) => {
         if (!token) return;
         setLoading(true);
         setError(null);
         try {
-            const fetchedFiles = await api.searchFiles(token, currentFilters);
-            setFiles(fetchedFiles || []);
+            const page = await api.searchFiles(token, currentFilters);
+            setFiles(page.items || []);
+            setFilesCursor(page.hasMore ? page.nextCursor : '');
         } catch (err) {
             setError(err.message);
             setFiles([]);
+            setFilesCursor('');
         } finally {
             setLoading(false);
         }
     }, [token]);
 
+    const loadMoreFiles = async () => {
+        if (!token || !filesCursor || loadingMoreFiles) return;
+        setLoadingMoreFiles(true);
+        try {
+            const page = await api.searchFiles(token, filters, filesCursor);
+            setFiles(prevFiles => prevFiles.concat(page.items || []));
+            setFilesCursor(page.hasMore ? page.nextCursor : '');
+        } catch (err) {
+            showToast(`Could not load more files: ${err.message}`, 'error');
+        } finally {
+            setLoadingMoreFiles(false);
+        }
+    };
+
     // --- Function to fetch files shared by the user ---
     const fetchSharedFiles = useCallback(async () => {
         if (!token) return;
         setSharedFilesLoading(true);
         try {
-            const fetchedSharedFiles = await api.getSharedByMeFiles(token);
-            setSharedFiles(fetchedSharedFiles || []);
+            const page = await api.getSharedByMeFiles(token);
+            setSharedFiles(page.items || []);
+            setSharedFilesCursor(page.hasMore ? page.nextCursor : '');
         } catch (err) {
             // We can show a toast on error for this view as well
             showToast(`Could not fetch shared files: ${err.message}`, 'error');
             setSharedFiles([]);
+            setSharedFilesCursor('');
         } finally {
             setSharedFilesLoading(false);
         }
     }, [token, showToast]);
 
+    const loadMoreSharedFiles = async () => {
+        if (!token || !sharedFilesCursor || loadingMoreSharedFiles) return;
+        setLoadingMoreSharedFiles(true);
+        try {
+            const page = await api.getSharedByMeFiles(token, sharedFilesCursor);
+            setSharedFiles(prevShared => prevShared.concat(page.items || []));
+            setSharedFilesCursor(page.hasMore ? page.nextCursor : '');
+        } catch (err) {
+            showToast(`Could not load more shared files: ${err.message}`, 'error');
+        } finally {
+            setLoadingMoreSharedFiles(false);
+        }
+    };
+
     const fetchHistory = useCallback(async () => {
         if (!token) return;
         setHistoryLoading(true);
         try {
-            const fetchedHistory = await api.getAuditLogs(token);
-            setHistory(fetchedHistory || []);
+            const page = await api.getAuditLogs(token);
+            setHistory(page.items || []);
+            setHistoryCursor(page.hasMore ? page.nextCursor : '');
         } catch (err) {
             showToast(`Could not fetch activity history: ${err.message}`, 'error');
             setHistory([]);
+            setHistoryCursor('');
         } finally {
             setHistoryLoading(false);
         }
     }, [token, showToast]);
 
+    const loadMoreHistory = async () => {
+        if (!token || !historyCursor || loadingMoreHistory) return;
+        setLoadingMoreHistory(true);
+        try {
+            const page = await api.getAuditLogs(token, historyCursor);
+            setHistory(prevHistory => prevHistory.concat(page.items || []));
+            setHistoryCursor(page.hasMore ? page.nextCursor : '');
+        } catch (err) {
+            showToast(`Could not load more activity: ${err.message}`, 'error');
+        } finally {
+            setLoadingMoreHistory(false);
+        }
+    };
+
     useEffect(() => {
         // This fetches for the main "All Files" and "Received" views
         fetchFiles(filters); 
@@ -101,14 +155,23 @@ export function FileProvider({ children }) {
         setFilters,
         deleteFile,
         refreshFiles, 
+        hasMoreFiles: Boolean(filesCursor),
+        loadingMoreFiles,
+        loadMoreFiles,
         
         // --- Expose shared files state and functions ---
         sharedFiles,
         sharedFilesLoading,
         refreshSharedFiles,
+        hasMoreSharedFiles: Boolean(sharedFilesCursor),
+        loadingMoreSharedFiles,
+        loadMoreSharedFiles,
         history,
         historyLoading,
         refreshHistory,
+        hasMoreHistory: Boolean(historyCursor),
+        loadingMoreHistory,
+        loadMoreHistory,
     };
 
     return (
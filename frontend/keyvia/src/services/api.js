@@ -11,6 +11,10 @@ async function handleResponse(response) {
   return data;
 }
 
+// Listing endpoints return one page as { items, nextCursor, hasMore } when a
+// limit is sent; pass nextCursor back to fetch the following page.
+export const PAGE_SIZE = 50;
+
 // --- Auth Functions ---
 export async function login(username, password) {
   const response = await fetch(`${API_BASE_URL}/auth/login`, {
@@ -32,14 +36,14 @@ export async function signup(name, username, password) {
 
 
 // --- File Management Functions ---
-export async function searchFiles(token, filters = {}) {
+export async function searchFiles(token, filters = {}, cursor = '') {
   const response = await fetch(`${API_BASE_URL}/api/files/search`, {
     method: 'POST', 
     headers: {
       'Content-Type': 'application/json',
       'Authorization': `Bearer ${token}`,
     },
-    body: JSON.stringify({ filters }),
+    body: JSON.stringify({ filters, cursor, limit: PAGE_SIZE }),
   });
   return handleResponse(response);
 }
@@ -139,6 +143,34 @@ export async function shareFilePublicly(token, fileId) {
   return handleResponse(response);
 }
 
+/**
+ * Lists the active public links of a file.
+ * @param {string} token - The user's JWT token.
+ * @param {number} fileId - The ID of the file.
+ * @returns {Promise<object>} - An object with a `links` array.
+ */
+export async function listPublicLinks(token, fileId) {
+  const response = await fetch(`${API_BASE_URL}/api/files/${fileId}/public-links`, {
+    method: 'GET',
+    headers: { 'Authorization': `Bearer ${token}` },
+  });
+  return handleResponse(response);
+}
+
+/**
+ * Mints a short-lived signed URL that downloads a file without auth headers.
+ * @param {string} token - The user's JWT token.
+ * @param {number} fileId - The ID of the file to download.
+ * @returns {Promise<object>} - An object with the signed `url` and `expiresAt`.
+ */
+export async function getSignedDownloadUrl(token, fileId) {
+  const response = await fetch(`${API_BASE_URL}/api/files/${fileId}/download-url`, {
+    method: 'POST',
+    headers: { 'Authorization': `Bearer ${token}` },
+  });
+  return handleResponse(response);
+}
+
 /**
  * Shares a file with a specific user.
  * @param {string} token - The user's JWT token.
@@ -177,10 +209,12 @@ export async function getAnalytics(token) {
 /**
  * Fetches files shared BY the current user.
  * @param {string} token - The user's JWT token.
- * @returns {Promise<Array>} - An array of file objects shared by the user.
+ * @param {string} [cursor] - The nextCursor of the previous page.
+ * @returns {Promise<Object>} - A page of file objects shared by the user.
  */
-export async function getSharedByMeFiles(token) {
-  const response = await fetch(`${API_BASE_URL}/api/files/shared-by-me`, {
+export async function getSharedByMeFiles(token, cursor = '') {
+  const params = new URLSearchParams({ limit: PAGE_SIZE, cursor });
+  const response = await fetch(`${API_BASE_URL}/api/files/shared-by-me?${params}`, {
     method: 'GET', // As defined in the Go backend
     headers: {
       'Authorization': `Bearer ${token}`,
@@ -193,10 +227,12 @@ export async function getSharedByMeFiles(token) {
 /**
  * Fetches the audit log history for the authenticated user.
  * @param {string} token - The user's JWT token.
- * @returns {Promise<Array>} - An array of audit log entry objects.
+ * @param {string} [cursor] - The nextCursor of the previous page.
+ * @returns {Promise<Object>} - A page of audit log entry objects.
  */
-export async function getAuditLogs(token) {
-  const response = await fetch(`${API_BASE_URL}/api/logs`, {
+export async function getAuditLogs(token, cursor = '') {
+  const params = new URLSearchParams({ limit: PAGE_SIZE, cursor });
+  const response = await fetch(`${API_BASE_URL}/api/logs?${params}`, {
     method: 'GET',
     headers: {
       'Authorization': `Bearer ${token}`,